@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"net"
+)
+
+const (
+	FAMILY_IPV4 = "ipv4"
+	FAMILY_IPV6 = "ipv6"
+)
+
+// NetAddress is an address assigned to a local interface
+type NetAddress struct {
+	Interface string `json:"interface"`
+	Mac       string `json:"mac,omitempty"`
+	Ip        string `json:"ip"`
+	Family    string `json:"family"`
+	// the address used for the default route
+	Primary bool `json:"primary,omitempty"`
+}
+
+// outboundIP returns the local address the kernel picks to reach target.
+// Dialing UDP only selects a route, nothing is sent.
+func outboundIP(network string, target string) net.IP {
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if localAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return localAddr.IP
+	}
+	return nil
+}
+
+func outboundIPv4() net.IP {
+	return outboundIP("udp4", "8.8.8.8:80")
+}
+
+func outboundIPv6() net.IP {
+	return outboundIP("udp6", "[2001:4860:4860::8888]:80")
+}
+
+// Get preferred outbound ip of this machine, empty when there is no route
+func getOutboundIP() string {
+	if ip := outboundIPv4(); ip != nil {
+		return ip.String()
+	}
+	if ip := outboundIPv6(); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// getAddresses lists the addresses of all non-loopback interfaces that are up
+func getAddresses() []NetAddress {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	primary4 := outboundIPv4()
+	primary6 := outboundIPv6()
+
+	var result []NetAddress
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ip := ipNet.IP
+			na := NetAddress{
+				Interface: iface.Name,
+				Mac:       iface.HardwareAddr.String(),
+				Ip:        ip.String(),
+				Family:    FAMILY_IPV6,
+			}
+			if ip.To4() != nil {
+				na.Family = FAMILY_IPV4
+				na.Primary = primary4 != nil && primary4.Equal(ip)
+			} else {
+				na.Primary = primary6 != nil && primary6.Equal(ip)
+			}
+			result = append(result, na)
+		}
+	}
+	return result
+}
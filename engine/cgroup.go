@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	CGROUP_V1 = 1
+	CGROUP_V2 = 2
+)
+
+var cgroupRoot = "/sys/fs/cgroup"
+
+// v1 reports "no limit" as a page aligned LONG_MAX
+const cgroupV1Unlimited = uint64(1) << 62
+
+// cgroupVersion returns CGROUP_V2 for the unified hierarchy, CGROUP_V1 for the
+// legacy one and 0 when no cgroup filesystem is mounted at root
+func cgroupVersion(root string) int {
+	if _, err := os.Stat(path.Join(root, "cgroup.controllers")); err == nil {
+		return CGROUP_V2
+	}
+	if _, err := os.Stat(path.Join(root, "memory")); err == nil {
+		return CGROUP_V1
+	}
+	return 0
+}
+
+// cgroupPaths holds the directories of one cgroup. On v2 all of them point
+// to the same directory.
+type cgroupPaths struct {
+	version int
+	memory  string
+	cpu     string
+	cpuacct string
+	blkio   string
+	pids    string
+}
+
+// cgroupStats is the resource usage of one cgroup
+type cgroupStats struct {
+	// 0 when unlimited
+	MemoryLimit uint64
+	// excludes inactive page cache, like docker stats
+	MemoryUsage uint64
+	// cumulative CPU time in nanoseconds
+	CpuUsage uint64
+	// CPU quota in cores, 0 when unlimited
+	CpuQuota float64
+	// cumulative bytes over all block devices
+	IoReadBytes  uint64
+	IoWriteBytes uint64
+	Pids         uint64
+	// 0 when unlimited
+	PidsLimit uint64
+}
+
+// existingDir returns dir, or root when dir is not visible in this mount
+// namespace, as for containers without a private cgroup namespace
+func existingDir(root string, dir string) string {
+	full := path.Join(root, dir)
+	if _, err := os.Stat(full); err == nil {
+		return full
+	}
+	return root
+}
+
+func v2CgroupPaths(dir string) cgroupPaths {
+	return cgroupPaths{version: CGROUP_V2, memory: dir, cpu: dir, cpuacct: dir, blkio: dir, pids: dir}
+}
+
+// v1CgroupPaths returns the directories of the cgroup at rel below each
+// controller mount of root
+func v1CgroupPaths(root string, rel string) cgroupPaths {
+	return cgroupPaths{
+		version: CGROUP_V1,
+		memory:  path.Join(root, "memory", rel),
+		cpu:     path.Join(root, "cpu", rel),
+		cpuacct: path.Join(root, "cpuacct", rel),
+		blkio:   path.Join(root, "blkio", rel),
+		pids:    path.Join(root, "pids", rel),
+	}
+}
+
+// selfCgroup finds the cgroup of the agent process from /proc/self/cgroup
+func selfCgroup() (cgroupPaths, error) {
+	result := cgroupPaths{version: cgroupVersion(cgroupRoot)}
+	if result.version == 0 {
+		return result, errors.New("no cgroup filesystem mounted")
+	}
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if result.version == CGROUP_V2 {
+			if fields[0] == "0" {
+				dir := existingDir(cgroupRoot, fields[2])
+				return v2CgroupPaths(dir), nil
+			}
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			switch controller {
+			case "memory":
+				result.memory = existingDir(path.Join(cgroupRoot, fields[1]), fields[2])
+			case "cpu":
+				result.cpu = existingDir(path.Join(cgroupRoot, fields[1]), fields[2])
+			case "cpuacct":
+				result.cpuacct = existingDir(path.Join(cgroupRoot, fields[1]), fields[2])
+			case "blkio":
+				result.blkio = existingDir(path.Join(cgroupRoot, fields[1]), fields[2])
+			case "pids":
+				result.pids = existingDir(path.Join(cgroupRoot, fields[1]), fields[2])
+			}
+		}
+	}
+	if len(result.memory) == 0 || len(result.cpu) == 0 || len(result.cpuacct) == 0 {
+		return result, errors.New("memory or cpu controller not found in /proc/self/cgroup")
+	}
+	return result, scanner.Err()
+}
+
+func readCgroupUint(fileName string) (uint64, error) {
+	value := readTrimmed(fileName)
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readCgroupStat returns one key of a flat keyed file like memory.stat
+func readCgroupStat(fileName string, key string) uint64 {
+	data := readTrimmed(fileName)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseUint(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+func subtractFloor(value uint64, sub uint64) uint64 {
+	if sub > value {
+		return 0
+	}
+	return value - sub
+}
+
+// sumIoStat adds up the read and write bytes of all devices in io.stat
+// ("8:0 rbytes=1 wbytes=2 rios=3 ...") or v1 blkio.throttle.io_service_bytes
+// ("8:0 Read 1")
+func sumIoStat(fileName string) (read uint64, write uint64) {
+	for _, line := range strings.Split(readTrimmed(fileName), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 3 && !strings.Contains(fields[1], "=") {
+			value, _ := strconv.ParseUint(fields[2], 10, 64)
+			switch fields[1] {
+			case "Read":
+				read += value
+			case "Write":
+				write += value
+			}
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value, _ := strconv.ParseUint(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				read += value
+			case "wbytes":
+				write += value
+			}
+		}
+	}
+	return
+}
+
+// readCgroup reads memory, CPU, IO and PID usage and limits of a cgroup. IO
+// and PIDs are best effort, their controllers are not always enabled.
+func readCgroup(p cgroupPaths) (cgroupStats, error) {
+	var result cgroupStats
+	var err error
+	result.Pids, _ = readCgroupUint(path.Join(p.pids, "pids.current"))
+	result.PidsLimit, _ = readCgroupUint(path.Join(p.pids, "pids.max"))
+	if p.version == CGROUP_V2 {
+		result.IoReadBytes, result.IoWriteBytes = sumIoStat(path.Join(p.blkio, "io.stat"))
+		if result.MemoryUsage, err = readCgroupUint(path.Join(p.memory, "memory.current")); err != nil {
+			return result, err
+		}
+		result.MemoryUsage = subtractFloor(result.MemoryUsage, readCgroupStat(path.Join(p.memory, "memory.stat"), "inactive_file"))
+		result.MemoryLimit, _ = readCgroupUint(path.Join(p.memory, "memory.max"))
+		// usage_usec is in microseconds
+		result.CpuUsage = readCgroupStat(path.Join(p.cpu, "cpu.stat"), "usage_usec") * 1000
+		// "$MAX $PERIOD"
+		fields := strings.Fields(readTrimmed(path.Join(p.cpu, "cpu.max")))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, _ := strconv.ParseFloat(fields[0], 64)
+			period, _ := strconv.ParseFloat(fields[1], 64)
+			if period > 0 {
+				result.CpuQuota = quota / period
+			}
+		}
+		return result, nil
+	}
+
+	result.IoReadBytes, result.IoWriteBytes = sumIoStat(path.Join(p.blkio, "blkio.throttle.io_service_bytes"))
+	if result.MemoryUsage, err = readCgroupUint(path.Join(p.memory, "memory.usage_in_bytes")); err != nil {
+		return result, err
+	}
+	result.MemoryUsage = subtractFloor(result.MemoryUsage, readCgroupStat(path.Join(p.memory, "memory.stat"), "total_inactive_file"))
+	if result.MemoryLimit, _ = readCgroupUint(path.Join(p.memory, "memory.limit_in_bytes")); result.MemoryLimit >= cgroupV1Unlimited {
+		result.MemoryLimit = 0
+	}
+	if result.CpuUsage, err = readCgroupUint(path.Join(p.cpuacct, "cpuacct.usage")); err != nil {
+		return result, err
+	}
+	// -1 means no quota
+	quota, _ := strconv.ParseFloat(readTrimmed(path.Join(p.cpu, "cpu.cfs_quota_us")), 64)
+	period, _ := strconv.ParseFloat(readTrimmed(path.Join(p.cpu, "cpu.cfs_period_us")), 64)
+	if quota > 0 && period > 0 {
+		result.CpuQuota = quota / period
+	}
+	return result, nil
+}
+
+// cpuCores rounds a CPU quota up to whole cores, capped by the usable CPUs
+func cpuCores(quota float64, available int) int {
+	if quota <= 0 {
+		return available
+	}
+	cores := int(math.Ceil(quota))
+	if cores > available {
+		return available
+	}
+	return cores
+}
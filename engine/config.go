@@ -0,0 +1,326 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/phayes/permbits"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_FILE_NAME   = "agent.yaml"
+	SYSTEM_CONFIG_FILE = "/etc/binadox-agent/" + CONFIG_FILE_NAME
+	ENV_PREFIX         = "BINADOX_"
+)
+
+type EndpointConfig struct {
+	Url         string        `yaml:"url"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+}
+
+type OutboxConfig struct {
+	MaxEntries int           `yaml:"max_entries"`
+	MaxBytes   int64         `yaml:"max_bytes"`
+	MaxAge     time.Duration `yaml:"max_age"`
+}
+
+// TagFilter selects the tags, or other names like network interfaces, sent to
+// Binadox. Patterns are shell globs matched case-insensitively against the
+// key; deny wins over allow and an empty allow list allows everything.
+type TagFilter struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// keys that commonly carry credentials or scripts. They are always denied,
+// cloud.tags.deny adds to them.
+var DEFAULT_TAG_DENY = []string{
+	"ssh-keys", "sshkeys", "block-project-ssh-keys", "windows-keys",
+	"*startup-script*", "*shutdown-script*", "*specialize-script*",
+	"user-data", "kube-env", "configure-sh",
+	"*password*", "*secret*", "*token*", "*credential*",
+}
+
+// CloudConfig controls instance identification
+type CloudConfig struct {
+	// providers to probe in priority order, all registered ones when empty
+	Providers         []string `yaml:"providers"`
+	DisabledProviders []string `yaml:"disabled_providers"`
+	// overall deadline for probing
+	Timeout time.Duration `yaml:"timeout"`
+	// metadata service base url by provider name, e.g. for a local stand-in
+	MetadataUrls map[string]string `yaml:"metadata_urls"`
+	// do not preselect the provider from /sys/class/dmi/id
+	SkipDmi bool `yaml:"skip_dmi"`
+	// allow plain IMDSv1 requests when no IMDSv2 session token can be obtained
+	AwsImdsV1Fallback bool `yaml:"aws_imds_v1_fallback"`
+	// ask the metadata service for the public IP address
+	ReportPublicIp bool      `yaml:"report_public_ip"`
+	Tags           TagFilter `yaml:"tags"`
+}
+
+// KubernetesConfig controls cluster detection when running in a pod
+type KubernetesConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// API server url, https://$KUBERNETES_SERVICE_HOST:$KUBERNETES_SERVICE_PORT when empty
+	ApiUrl string `yaml:"api_url"`
+	// reported instead of the name found in node labels or cloud tags
+	ClusterName string `yaml:"cluster_name"`
+}
+
+// Config holds the agent settings. Values are resolved with the precedence
+// command line flag > BINADOX_* environment variable > config file > default.
+type Config struct {
+	Token          string        `yaml:"token"`
+	TokenFile      string        `yaml:"token_file"`
+	WorkDir        string        `yaml:"workdir"`
+	Daemon         bool          `yaml:"daemon"`
+	Interval       time.Duration `yaml:"interval"`
+	UpdateInterval time.Duration `yaml:"update_interval"`
+	// how often spot instances check for interruption notices in daemon mode
+	InterruptionInterval time.Duration    `yaml:"interruption_interval"`
+	Collectors           []string         `yaml:"collectors"`
+	Endpoint             EndpointConfig   `yaml:"endpoint"`
+	Outbox               OutboxConfig     `yaml:"outbox"`
+	Cloud                CloudConfig      `yaml:"cloud"`
+	Kubernetes           KubernetesConfig `yaml:"kubernetes"`
+	// whether machine statistics describe the host or the agent's container:
+	// auto, host or container
+	StatsView string `yaml:"stats_view"`
+	// Docker API socket used to name containers
+	DockerSocket string `yaml:"docker_socket"`
+	// add the CPU mode breakdown of every core
+	CpuPerCore bool `yaml:"cpu_per_core"`
+	// interfaces reported in stat.interfaces
+	NetworkInterfaces TagFilter `yaml:"network_interfaces"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:             DEFAULT_COLLECT_INTERVAL,
+		UpdateInterval:       DEFAULT_UPDATE_INTERVAL,
+		InterruptionInterval: DEFAULT_INTERRUPTION_INTERVAL,
+		StatsView:            STATS_VIEW_AUTO,
+		DockerSocket:         DEFAULT_DOCKER_SOCKET,
+		NetworkInterfaces:    TagFilter{Deny: DEFAULT_INTERFACE_DENY},
+		Endpoint: EndpointConfig{
+			Timeout:     DEFAULT_REQUEST_TIMEOUT,
+			MaxAttempts: DEFAULT_DELIVERY_ATTEMPTS,
+		},
+		Outbox: OutboxConfig{
+			MaxEntries: DEFAULT_OUTBOX_MAX_ENTRIES,
+			MaxBytes:   DEFAULT_OUTBOX_MAX_BYTES,
+			MaxAge:     DEFAULT_OUTBOX_MAX_AGE,
+		},
+		Cloud: CloudConfig{
+			Timeout: DEFAULT_PROBE_TIMEOUT,
+		},
+	}
+}
+
+// FindConfigFile returns the first existing config file in the work dir or
+// /etc, or an empty string
+func FindConfigFile() string {
+	for _, candidate := range []string{path.Join(GetWorkDir(), CONFIG_FILE_NAME), SYSTEM_CONFIG_FILE} {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// LoadFile overlays the settings found in a YAML file
+func (c *Config) LoadFile(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	// absent keys keep their current values
+	if err = yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(c.TokenFile) > 0 && !path.IsAbs(c.TokenFile) {
+		c.TokenFile = path.Join(path.Dir(fileName), c.TokenFile)
+	}
+	return nil
+}
+
+// SetToken sets the token, overriding a token file from a lower precedence source
+func (c *Config) SetToken(token string) {
+	c.Token = token
+	c.TokenFile = ""
+}
+
+// SetTokenFile sets the token file, overriding a token from a lower precedence source
+func (c *Config) SetTokenFile(fileName string) {
+	c.TokenFile = fileName
+	c.Token = ""
+}
+
+// ApplyEnv overlays BINADOX_* environment variables
+func (c *Config) ApplyEnv() error {
+	var err error
+	if v, ok := lookupEnv("TOKEN_FILE"); ok {
+		c.SetTokenFile(v)
+	}
+	if v, ok := lookupEnv("TOKEN"); ok {
+		c.SetToken(v)
+	}
+	if v, ok := lookupEnv("WORKDIR"); ok {
+		c.WorkDir = v
+	}
+	if v, ok := lookupEnv("URL"); ok {
+		c.Endpoint.Url = v
+	}
+	if v, ok := lookupEnv("DAEMON"); ok {
+		if c.Daemon, err = strconv.ParseBool(v); err != nil {
+			return envError("DAEMON", err)
+		}
+	}
+	if v, ok := lookupEnv("INTERVAL"); ok {
+		if c.Interval, err = time.ParseDuration(v); err != nil {
+			return envError("INTERVAL", err)
+		}
+	}
+	if v, ok := lookupEnv("UPDATE_INTERVAL"); ok {
+		if c.UpdateInterval, err = time.ParseDuration(v); err != nil {
+			return envError("UPDATE_INTERVAL", err)
+		}
+	}
+	if v, ok := lookupEnv("INTERRUPTION_INTERVAL"); ok {
+		if c.InterruptionInterval, err = time.ParseDuration(v); err != nil {
+			return envError("INTERRUPTION_INTERVAL", err)
+		}
+	}
+	if v, ok := lookupEnv("COLLECTORS"); ok {
+		c.Collectors = SplitList(v)
+	}
+	if v, ok := lookupEnv("STATS_VIEW"); ok {
+		c.StatsView = v
+	}
+	if v, ok := lookupEnv("DOCKER_SOCKET"); ok {
+		c.DockerSocket = v
+	}
+	if v, ok := lookupEnv("CPU_PER_CORE"); ok {
+		if c.CpuPerCore, err = strconv.ParseBool(v); err != nil {
+			return envError("CPU_PER_CORE", err)
+		}
+	}
+	if v, ok := lookupEnv("INTERFACES_ALLOW"); ok {
+		c.NetworkInterfaces.Allow = SplitList(v)
+	}
+	if v, ok := lookupEnv("INTERFACES_DENY"); ok {
+		c.NetworkInterfaces.Deny = SplitList(v)
+	}
+	if v, ok := lookupEnv("TIMEOUT"); ok {
+		if c.Endpoint.Timeout, err = time.ParseDuration(v); err != nil {
+			return envError("TIMEOUT", err)
+		}
+	}
+	if v, ok := lookupEnv("MAX_ATTEMPTS"); ok {
+		if c.Endpoint.MaxAttempts, err = strconv.Atoi(v); err != nil {
+			return envError("MAX_ATTEMPTS", err)
+		}
+	}
+	if v, ok := lookupEnv("OUTBOX_MAX_ENTRIES"); ok {
+		if c.Outbox.MaxEntries, err = strconv.Atoi(v); err != nil {
+			return envError("OUTBOX_MAX_ENTRIES", err)
+		}
+	}
+	if v, ok := lookupEnv("OUTBOX_MAX_BYTES"); ok {
+		if c.Outbox.MaxBytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return envError("OUTBOX_MAX_BYTES", err)
+		}
+	}
+	if v, ok := lookupEnv("OUTBOX_MAX_AGE"); ok {
+		if c.Outbox.MaxAge, err = time.ParseDuration(v); err != nil {
+			return envError("OUTBOX_MAX_AGE", err)
+		}
+	}
+	if v, ok := lookupEnv("AWS_IMDS_V1_FALLBACK"); ok {
+		if c.Cloud.AwsImdsV1Fallback, err = strconv.ParseBool(v); err != nil {
+			return envError("AWS_IMDS_V1_FALLBACK", err)
+		}
+	}
+	if v, ok := lookupEnv("CLOUD_PROVIDERS"); ok {
+		c.Cloud.Providers = SplitList(v)
+	}
+	if v, ok := lookupEnv("CLOUD_DISABLED_PROVIDERS"); ok {
+		c.Cloud.DisabledProviders = SplitList(v)
+	}
+	if v, ok := lookupEnv("CLOUD_TIMEOUT"); ok {
+		if c.Cloud.Timeout, err = time.ParseDuration(v); err != nil {
+			return envError("CLOUD_TIMEOUT", err)
+		}
+	}
+	if v, ok := lookupEnv("CLOUD_SKIP_DMI"); ok {
+		if c.Cloud.SkipDmi, err = strconv.ParseBool(v); err != nil {
+			return envError("CLOUD_SKIP_DMI", err)
+		}
+	}
+	if v, ok := lookupEnv("TAGS_ALLOW"); ok {
+		c.Cloud.Tags.Allow = SplitList(v)
+	}
+	if v, ok := lookupEnv("TAGS_DENY"); ok {
+		c.Cloud.Tags.Deny = SplitList(v)
+	}
+	if v, ok := lookupEnv("REPORT_PUBLIC_IP"); ok {
+		if c.Cloud.ReportPublicIp, err = strconv.ParseBool(v); err != nil {
+			return envError("REPORT_PUBLIC_IP", err)
+		}
+	}
+	if v, ok := lookupEnv("KUBERNETES_DISABLED"); ok {
+		if c.Kubernetes.Disabled, err = strconv.ParseBool(v); err != nil {
+			return envError("KUBERNETES_DISABLED", err)
+		}
+	}
+	if v, ok := lookupEnv("KUBERNETES_API_URL"); ok {
+		c.Kubernetes.ApiUrl = v
+	}
+	if v, ok := lookupEnv("KUBERNETES_CLUSTER_NAME"); ok {
+		c.Kubernetes.ClusterName = v
+	}
+	return nil
+}
+
+// ResolveToken returns the token, reading it from TokenFile when needed
+func (c *Config) ResolveToken() (string, error) {
+	if len(c.Token) > 0 || len(c.TokenFile) == 0 {
+		return c.Token, nil
+	}
+	if permissions, err := permbits.Stat(c.TokenFile); err == nil && permissions.OtherRead() {
+		log.Printf("Warning: token file %s is readable by other users", c.TokenFile)
+	}
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SplitList splits a comma separated list, dropping empty items
+func SplitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func lookupEnv(name string) (string, bool) {
+	return os.LookupEnv(ENV_PREFIX + name)
+}
+
+func envError(name string, err error) error {
+	return fmt.Errorf("%s%s: %v", ENV_PREFIX, name, err)
+}
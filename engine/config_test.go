@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// restoreTestEnv puts an environment variable back when the test ends
+func restoreTestEnv(t *testing.T, name string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(name)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// setTestEnv sets an environment variable until the test ends
+func setTestEnv(t *testing.T, name string, value string) {
+	t.Helper()
+	restoreTestEnv(t, name)
+	os.Setenv(name, value)
+}
+
+// writeConfigFile writes agent.yaml to a temporary directory
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), CONFIG_FILE_NAME)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name          string
+		file          string
+		env           map[string]string
+		wantUrl       string
+		wantInterval  time.Duration
+		wantToken     string
+		wantTokenFile string
+	}{
+		{"defaults", "", nil, "", DEFAULT_COLLECT_INTERVAL, "", ""},
+		{"file over default", "endpoint:\n  url: https://file\ninterval: 10m\ntoken: file-token\n", nil,
+			"https://file", 10 * time.Minute, "file-token", ""},
+		{"env over file", "endpoint:\n  url: https://file\ninterval: 10m\ntoken: file-token\n",
+			map[string]string{"URL": "https://env", "INTERVAL": "20m", "TOKEN": "env-token"},
+			"https://env", 20 * time.Minute, "env-token", ""},
+		{"env without file", "", map[string]string{"URL": "https://env"}, "https://env", DEFAULT_COLLECT_INTERVAL, "", ""},
+		{"absent env keeps file", "interval: 10m\n", map[string]string{"URL": "https://env"},
+			"https://env", 10 * time.Minute, "", ""},
+		{"env token file replaces file token", "token: file-token\n", map[string]string{"TOKEN_FILE": "/run/secrets/token"},
+			"", DEFAULT_COLLECT_INTERVAL, "", "/run/secrets/token"},
+		{"env token replaces file token file", "token_file: /etc/binadox-agent/token\n", map[string]string{"TOKEN": "env-token"},
+			"", DEFAULT_COLLECT_INTERVAL, "env-token", ""},
+		// both in the environment: the token is applied last
+		{"env token and token file", "", map[string]string{"TOKEN": "env-token", "TOKEN_FILE": "/run/secrets/token"},
+			"", DEFAULT_COLLECT_INTERVAL, "env-token", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"URL", "INTERVAL", "TOKEN", "TOKEN_FILE"} {
+				restoreTestEnv(t, ENV_PREFIX+name)
+				os.Unsetenv(ENV_PREFIX + name)
+			}
+			for name, value := range tt.env {
+				setTestEnv(t, ENV_PREFIX+name, value)
+			}
+			c := DefaultConfig()
+			if len(tt.file) > 0 {
+				if err := c.LoadFile(writeConfigFile(t, tt.file)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.ApplyEnv(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Endpoint.Url != tt.wantUrl {
+				t.Errorf("url = %q, want %q", c.Endpoint.Url, tt.wantUrl)
+			}
+			if c.Interval != tt.wantInterval {
+				t.Errorf("interval = %v, want %v", c.Interval, tt.wantInterval)
+			}
+			if c.Token != tt.wantToken || c.TokenFile != tt.wantTokenFile {
+				t.Errorf("token = %q, token file = %q, want %q, %q", c.Token, c.TokenFile, tt.wantToken, tt.wantTokenFile)
+			}
+		})
+	}
+}
+
+func TestConfigSetToken(t *testing.T) {
+	c := DefaultConfig()
+	c.SetTokenFile("/run/secrets/token")
+	c.SetToken("flag-token")
+	if c.Token != "flag-token" || len(c.TokenFile) > 0 {
+		t.Errorf("after SetToken: token = %q, token file = %q", c.Token, c.TokenFile)
+	}
+	c.SetTokenFile("/run/secrets/token")
+	if len(c.Token) > 0 || c.TokenFile != "/run/secrets/token" {
+		t.Errorf("after SetTokenFile: token = %q, token file = %q", c.Token, c.TokenFile)
+	}
+}
+
+// a relative token_file is relative to the config file, not the working directory
+func TestConfigRelativeTokenFile(t *testing.T) {
+	fileName := writeConfigFile(t, "token_file: secrets/token\n")
+	dir := filepath.Dir(fileName)
+	if err := os.MkdirAll(filepath.Join(dir, "secrets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secrets", "token"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := DefaultConfig()
+	if err := c.LoadFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "secrets", "token"); c.TokenFile != want {
+		t.Errorf("token file = %q, want %q", c.TokenFile, want)
+	}
+	token, err := c.ResolveToken()
+	if err != nil || token != "file-token" {
+		t.Errorf("ResolveToken() = %q, %v, want file-token", token, err)
+	}
+}
+
+func TestConfigLoadFileUnknownKey(t *testing.T) {
+	c := DefaultConfig()
+	if err := c.LoadFile(writeConfigFile(t, "intervall: 10m\n")); err == nil {
+		t.Error("LoadFile() accepted an unknown key")
+	}
+}
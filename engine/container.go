@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	STATS_VIEW_AUTO      = "auto"
+	STATS_VIEW_HOST      = "host"
+	STATS_VIEW_CONTAINER = "container"
+)
+
+// ContainerInfo describes the container the agent runs in
+type ContainerInfo struct {
+	// docker, podman, containerd, cri-o, lxc, kubernetes or container when
+	// only the root filesystem gave it away
+	Runtime string `json:"runtime"`
+	Id      string `json:"id,omitempty"`
+}
+
+var containerIdPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// cgroup path fragments by runtime, checked in order
+var containerCgroupMarkers = []struct {
+	marker  string
+	runtime string
+}{
+	{"libpod", "podman"},
+	{"crio-", "cri-o"},
+	{"cri-containerd", "containerd"},
+	{"docker", "docker"},
+	{"kubepods", "kubernetes"},
+	{"containerd", "containerd"},
+	{"/lxc/", "lxc"},
+	{"lxc.payload", "lxc"},
+}
+
+// detectContainer returns nil when the agent does not run in a container.
+// The proc files are read from the agent's own namespace, never from HOST_PROC.
+func detectContainer() *ContainerInfo {
+	cgroups := readTrimmed("/proc/self/cgroup")
+	mountInfo, _ := ioutil.ReadFile("/proc/self/mountinfo")
+
+	var result *ContainerInfo
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		result = &ContainerInfo{Runtime: "docker"}
+	} else if _, err := os.Stat("/run/.containerenv"); err == nil {
+		result = &ContainerInfo{Runtime: "podman"}
+	} else if runtime := os.Getenv("container"); len(runtime) > 0 {
+		// set by podman, lxc and systemd-nspawn
+		result = &ContainerInfo{Runtime: runtime}
+	} else {
+		for _, m := range containerCgroupMarkers {
+			if strings.Contains(cgroups, m.marker) {
+				result = &ContainerInfo{Runtime: m.runtime}
+				break
+			}
+		}
+	}
+	if result == nil && overlayRoot(string(mountInfo)) {
+		result = &ContainerInfo{Runtime: "container"}
+	}
+	if result == nil {
+		return nil
+	}
+	// with a private cgroup namespace the id is only found in mount sources
+	// such as /var/lib/docker/containers/<id>/hostname
+	if id := containerIdPattern.FindString(cgroups); len(id) > 0 {
+		result.Id = id
+	} else {
+		result.Id = containerIdPattern.FindString(string(mountInfo))
+	}
+	return result
+}
+
+// overlayRoot reports whether / is an overlay mount, which hosts rarely use
+func overlayRoot(mountInfo string) bool {
+	for _, line := range strings.Split(mountInfo, "\n") {
+		// id parent major:minor root mountpoint options ... - fstype source super-options
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != "/" {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				return fields[i+1] == "overlay"
+			}
+		}
+	}
+	return false
+}
+
+var (
+	currentContainer *ContainerInfo
+	statsView        = STATS_VIEW_HOST
+	// cgroup of the agent, read in the container view
+	selfCgroupPaths cgroupPaths
+)
+
+// SetStatsView selects whether machine statistics describe the host or the
+// container the agent runs in. The auto view picks the container when the
+// agent is containerized, unless HOST_PROC or HOST_SYS expose the host or it
+// runs in a Kubernetes pod, where it is expected to report its node.
+// Memory, CPU load, network and pressure follow the view. Disk usage, disk
+// IO, uptime, CPU modes and load averages come from kernel files that are
+// not namespaced and always describe the host.
+func SetStatsView(view string) error {
+	currentContainer = detectContainer()
+	switch view {
+	case "", STATS_VIEW_AUTO:
+		view = STATS_VIEW_HOST
+		hostMounted := len(os.Getenv("HOST_PROC")) > 0 || len(os.Getenv("HOST_SYS")) > 0
+		if currentContainer != nil && !hostMounted && !inKubernetes() {
+			view = STATS_VIEW_CONTAINER
+		}
+	case STATS_VIEW_HOST, STATS_VIEW_CONTAINER:
+	default:
+		return fmt.Errorf("unknown stats view %q, expected %s, %s or %s", view, STATS_VIEW_AUTO, STATS_VIEW_HOST, STATS_VIEW_CONTAINER)
+	}
+	if view == STATS_VIEW_CONTAINER {
+		var err error
+		if selfCgroupPaths, err = selfCgroup(); err != nil {
+			log.Printf("Container statistics are not available, reporting the host: %v", err)
+			view = STATS_VIEW_HOST
+		}
+	}
+	statsView = view
+	return nil
+}
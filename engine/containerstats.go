@@ -0,0 +1,200 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_DOCKER_SOCKET = "/var/run/docker.sock"
+
+// Docker API socket used to name containers, podman serves the same API.
+// containerd and CRI-O only offer gRPC, their containers are reported by id.
+var dockerSocket = DEFAULT_DOCKER_SOCKET
+
+// ContainerStats is the resource usage of one container or systemd slice.
+// Counters are cumulative since the cgroup was created.
+type ContainerStats struct {
+	// container id, or the slice name
+	Id      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Image   string `json:"image,omitempty"`
+	Runtime string `json:"runtime"`
+	// path below the cgroup root
+	Cgroup       string `json:"cgroup"`
+	CpuUsage     uint64 `json:"cpu_usage_ns"`
+	MemoryUsage  uint64 `json:"memory_usage"`
+	MemoryLimit  uint64 `json:"memory_limit,omitempty"`
+	IoReadBytes  uint64 `json:"io_read_bytes"`
+	IoWriteBytes uint64 `json:"io_write_bytes"`
+	Pids         uint64 `json:"pids"`
+	PidsLimit    uint64 `json:"pids_limit,omitempty"`
+}
+
+// scope names of the systemd cgroup driver, e.g. docker-<id>.scope
+var containerScopePattern = regexp.MustCompile(`^(docker|cri-containerd|crio|libpod)-([0-9a-f]{64})\.scope$`)
+
+// directory names of the cgroupfs driver, e.g. /docker/<id>
+var containerDirPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var scopeRuntimes = map[string]string{
+	"docker":         "docker",
+	"cri-containerd": "containerd",
+	"crio":           "cri-o",
+	"libpod":         "podman",
+}
+
+// SetDockerSocket sets the Docker API socket used to resolve container names
+func SetDockerSocket(socket string) {
+	dockerSocket = strings.TrimPrefix(socket, "unix://")
+}
+
+// hostCgroupRoot is the host's cgroup mount, HOST_SYS lets a container see it
+func hostCgroupRoot() string {
+	if len(os.Getenv("HOST_SYS")) > 0 {
+		return hostSysPath("fs", "cgroup")
+	}
+	return cgroupRoot
+}
+
+// containerCgroup classifies a cgroup directory, returning an empty runtime
+// for cgroups that are neither containers nor top level slices
+func containerCgroup(rel string) (id string, runtime string) {
+	name := path.Base(rel)
+	if m := containerScopePattern.FindStringSubmatch(name); m != nil {
+		return m[2], scopeRuntimes[m[1]]
+	}
+	if containerDirPattern.MatchString(name) {
+		switch {
+		case strings.Contains(rel, "docker"):
+			return name, "docker"
+		case strings.Contains(rel, "kubepods"):
+			return name, "kubernetes"
+		}
+		return name, "container"
+	}
+	if path.Dir(rel) == "/" && strings.HasSuffix(name, ".slice") {
+		return name, "systemd"
+	}
+	return "", ""
+}
+
+// findContainerCgroups walks the hierarchy below root and returns the
+// relative paths of container and slice cgroups
+func findContainerCgroups(root string) map[string]string {
+	result := make(map[string]string)
+	filepath.Walk(root, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(fileName, root), "/")
+		if _, runtime := containerCgroup(rel); len(runtime) > 0 {
+			result[rel] = runtime
+		}
+		return nil
+	})
+	return result
+}
+
+type dockerContainer struct {
+	Id    string   `json:"Id"`
+	Names []string `json:"Names"`
+	Image string   `json:"Image"`
+}
+
+// dockerContainers lists the running containers by id, or returns nil when
+// the socket is not available
+func dockerContainers() map[string]dockerContainer {
+	if _, err := os.Stat(dockerSocket); err != nil {
+		return nil
+	}
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		// one request per collection, an idle connection would outlive the client
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+	// the host part is ignored by the dialer
+	body, err := metadataGet(context.Background(), client, "http://docker/containers/json", nil)
+	if err != nil {
+		return nil
+	}
+	var containers []dockerContainer
+	if json.Unmarshal([]byte(body), &containers) != nil {
+		return nil
+	}
+	result := make(map[string]dockerContainer)
+	for _, c := range containers {
+		result[c.Id] = c
+	}
+	return result
+}
+
+// getContainerStats reports every container and top level systemd slice of
+// the host. It adds nothing when no cgroup filesystem is visible.
+func getContainerStats(ctx *FetcherContext, result *MachineStats) error {
+	root := hostCgroupRoot()
+	version := cgroupVersion(root)
+	walkRoot := root
+	if version == CGROUP_V1 {
+		walkRoot = path.Join(root, "memory")
+	} else if version != CGROUP_V2 {
+		return nil
+	}
+	cgroups := findContainerCgroups(walkRoot)
+	if len(cgroups) == 0 {
+		return nil
+	}
+	names := dockerContainers()
+
+	var stats []ContainerStats
+	for rel := range cgroups {
+		var paths cgroupPaths
+		if version == CGROUP_V2 {
+			paths = v2CgroupPaths(path.Join(root, rel))
+		} else {
+			paths = v1CgroupPaths(root, rel)
+		}
+		usage, err := readCgroup(paths)
+		if err != nil {
+			// the container exited while walking
+			continue
+		}
+		id, runtime := containerCgroup(rel)
+		cs := ContainerStats{
+			Id:           id,
+			Runtime:      runtime,
+			Cgroup:       rel,
+			CpuUsage:     usage.CpuUsage,
+			MemoryUsage:  usage.MemoryUsage,
+			MemoryLimit:  usage.MemoryLimit,
+			IoReadBytes:  usage.IoReadBytes,
+			IoWriteBytes: usage.IoWriteBytes,
+			Pids:         usage.Pids,
+			PidsLimit:    usage.PidsLimit,
+		}
+		if c, ok := names[id]; ok {
+			if len(c.Names) > 0 {
+				cs.Name = strings.TrimPrefix(c.Names[0], "/")
+			}
+			cs.Image = c.Image
+		}
+		stats = append(stats, cs)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Cgroup < stats[j].Cgroup })
+	result.Containers = stats
+	return nil
+}
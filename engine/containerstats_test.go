@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const testContainerId = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fileName := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeDockerSocket serves GET /containers/json on a unix socket
+func fakeDockerSocket(t *testing.T, containers string) string {
+	t.Helper()
+	socket := path.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(containers))
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return socket
+}
+
+func TestGetContainerStats(t *testing.T) {
+	scope := "/system.slice/docker-" + testContainerId + ".scope"
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []ContainerStats
+	}{
+		{"cgroup v2", map[string]string{
+			"cgroup.controllers":           "cpu memory io pids",
+			scope + "/memory.current":      "1000",
+			scope + "/memory.stat":         "inactive_file 100\n",
+			scope + "/memory.max":          "max",
+			scope + "/cpu.stat":            "usage_usec 5\n",
+			scope + "/io.stat":             "8:0 rbytes=10 wbytes=20 rios=1\n8:16 rbytes=1 wbytes=2\n",
+			scope + "/pids.current":        "3",
+			scope + "/pids.max":            "100",
+			"/system.slice/memory.current": "5000",
+			"/system.slice/cpu.stat":       "usage_usec 7\n",
+		}, []ContainerStats{
+			{Id: "system.slice", Runtime: "systemd", Cgroup: "/system.slice", CpuUsage: 7000, MemoryUsage: 5000},
+			{Id: testContainerId, Name: "web", Image: "nginx", Runtime: "docker", Cgroup: scope,
+				CpuUsage: 5000, MemoryUsage: 900, IoReadBytes: 11, IoWriteBytes: 22, Pids: 3, PidsLimit: 100},
+		}},
+		{"cgroup v1", map[string]string{
+			"/memory/docker/" + testContainerId + "/memory.usage_in_bytes":          "2000",
+			"/memory/docker/" + testContainerId + "/memory.limit_in_bytes":          "9223372036854771712",
+			"/cpuacct/docker/" + testContainerId + "/cpuacct.usage":                 "99",
+			"/blkio/docker/" + testContainerId + "/blkio.throttle.io_service_bytes": "8:0 Read 5\n8:0 Write 6\n8:0 Total 11\nTotal 11\n",
+		}, []ContainerStats{
+			{Id: testContainerId, Name: "web", Image: "nginx", Runtime: "docker", Cgroup: "/docker/" + testContainerId,
+				CpuUsage: 99, MemoryUsage: 2000, IoReadBytes: 5, IoWriteBytes: 6},
+		}},
+	}
+
+	previousRoot, previousSocket := cgroupRoot, dockerSocket
+	defer func() { cgroupRoot, dockerSocket = previousRoot, previousSocket }()
+	SetDockerSocket("unix://" + fakeDockerSocket(t,
+		fmt.Sprintf(`[{"Id":"%s","Names":["/web"],"Image":"nginx"}]`, testContainerId)))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cgroupRoot = t.TempDir()
+			writeTestFiles(t, cgroupRoot, tt.files)
+			var result MachineStats
+			if err := getContainerStats(nil, &result); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Containers, tt.want) {
+				t.Errorf("Containers = %+v, want %+v", result.Containers, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerContainers(t *testing.T) {
+	previous := dockerSocket
+	defer func() { dockerSocket = previous }()
+
+	SetDockerSocket(fakeDockerSocket(t, `[{"Id":"a","Names":["/web"],"Image":"nginx"},{"Id":"b","Names":["/db"],"Image":"postgres"}]`))
+	containers := dockerContainers()
+	if len(containers) != 2 || containers["b"].Image != "postgres" || containers["a"].Names[0] != "/web" {
+		t.Errorf("dockerContainers() = %+v", containers)
+	}
+
+	SetDockerSocket(fakeDockerSocket(t, `not json`))
+	if containers := dockerContainers(); containers != nil {
+		t.Errorf("dockerContainers() = %+v on a bad answer, want nil", containers)
+	}
+
+	SetDockerSocket(path.Join(t.TempDir(), "missing.sock"))
+	if containers := dockerContainers(); containers != nil {
+		t.Errorf("dockerContainers() = %+v without a socket, want nil", containers)
+	}
+}
+
+func TestDockerContainersReleasesConnections(t *testing.T) {
+	previous := dockerSocket
+	defer func() { dockerSocket = previous }()
+	SetDockerSocket(fakeDockerSocket(t, `[]`))
+
+	dockerContainers()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		dockerContainers()
+	}
+	// closed connections take a moment to wind down on the server side
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("%d goroutines after 50 calls, %d before", after, before)
+	}
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/load"
+)
+
+// report the mode breakdown of every core as well
+var cpuPerCore bool
+
+// CpuModes is the share of CPU time per mode over the sampling window, in
+// percent. Guest time is included in user.
+type CpuModes struct {
+	// cpu-total, or cpu0, cpu1... for single cores
+	Cpu     string  `json:"cpu"`
+	User    float32 `json:"user"`
+	Nice    float32 `json:"nice"`
+	System  float32 `json:"system"`
+	Idle    float32 `json:"idle"`
+	Iowait  float32 `json:"iowait"`
+	Irq     float32 `json:"irq"`
+	Softirq float32 `json:"softirq"`
+	Steal   float32 `json:"steal"`
+	Guest   float32 `json:"guest"`
+}
+
+// LoadAvg holds load averages and the run queue from /proc/stat
+type LoadAvg struct {
+	Load1        float64 `json:"load1"`
+	Load5        float64 `json:"load5"`
+	Load15       float64 `json:"load15"`
+	ProcsRunning int     `json:"procs_running"`
+	ProcsBlocked int     `json:"procs_blocked"`
+}
+
+// SetCpuPerCore enables the per-core CPU breakdown
+func SetCpuPerCore(enabled bool) {
+	cpuPerCore = enabled
+}
+
+// cpuTimes returns the total CPU times followed by the per-core times when
+// they are enabled
+func cpuTimes() ([]cpu.TimesStat, error) {
+	total, err := cpu.Times(false)
+	if err != nil || !cpuPerCore {
+		return total, err
+	}
+	cores, err := cpu.Times(true)
+	if err != nil {
+		return nil, err
+	}
+	return append(total, cores...), nil
+}
+
+// cpuModes computes the mode shares between two samples of the same CPU
+func cpuModes(before cpu.TimesStat, after cpu.TimesStat) CpuModes {
+	total := after.Total() - before.Total()
+	share := func(b float64, a float64) float32 {
+		if total <= 0 || a < b {
+			return 0
+		}
+		return float32(100 * (a - b) / total)
+	}
+	return CpuModes{
+		Cpu:     after.CPU,
+		User:    share(before.User, after.User),
+		Nice:    share(before.Nice, after.Nice),
+		System:  share(before.System, after.System),
+		Idle:    share(before.Idle, after.Idle),
+		Iowait:  share(before.Iowait, after.Iowait),
+		Irq:     share(before.Irq, after.Irq),
+		Softirq: share(before.Softirq, after.Softirq),
+		Steal:   share(before.Steal, after.Steal),
+		Guest:   share(before.Guest, after.Guest),
+	}
+}
+
+// setCpuModes fills the breakdown from samples returned by cpuTimes. Cores
+// that went offline in between are skipped.
+func setCpuModes(result *MachineStats, before []cpu.TimesStat, after []cpu.TimesStat) {
+	previous := make(map[string]cpu.TimesStat)
+	for _, t := range before {
+		previous[t.CPU] = t
+	}
+	for i, t := range after {
+		b, ok := previous[t.CPU]
+		if !ok {
+			continue
+		}
+		modes := cpuModes(b, t)
+		if i == 0 {
+			result.CpuModes = &modes
+		} else {
+			result.CpuCores = append(result.CpuCores, modes)
+		}
+	}
+}
+
+// getLoadAvg is not supported on every platform, it then reports nothing
+func getLoadAvg(result *MachineStats) {
+	avg, err := load.Avg()
+	if err != nil {
+		return
+	}
+	result.LoadAvg = &LoadAvg{Load1: avg.Load1, Load5: avg.Load5, Load15: avg.Load15}
+	if misc, err := load.Misc(); err == nil {
+		result.LoadAvg.ProcsRunning = misc.ProcsRunning
+		result.LoadAvg.ProcsBlocked = misc.ProcsBlocked
+	}
+}
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_DELIVERY_ATTEMPTS = 5
+	DEFAULT_INITIAL_BACKOFF   = time.Second
+	DEFAULT_MAX_BACKOFF       = time.Minute
+	DEFAULT_MAX_RETRY_AFTER   = 5 * time.Minute
+	DEFAULT_REQUEST_TIMEOUT   = 30 * time.Second
+)
+
+// DeliveryError describes a failed attempt to post data to the Binadox endpoint
+type DeliveryError struct {
+	StatusCode int
+	// Permanent is set when retrying the same payload can not succeed
+	Permanent bool
+	// RetryAfter is the delay requested by the server, if any
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("delivery failed: %v", e.Err)
+	}
+	return fmt.Sprintf("delivery failed: server responded with %d", e.StatusCode)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// IsAuthError reports whether the endpoint rejected the security token
+func (e *DeliveryError) IsAuthError() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// Delivery posts payloads to the Binadox endpoint retrying transient failures
+type Delivery struct {
+	Url            string
+	Token          string
+	Client         *http.Client
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Retry-After values above this limit end the retry loop
+	MaxRetryAfter time.Duration
+}
+
+func NewDelivery(url string, token string) *Delivery {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &Delivery{
+		Url:            url,
+		Token:          token,
+		Client:         &http.Client{Timeout: DEFAULT_REQUEST_TIMEOUT, Transport: transport},
+		MaxAttempts:    DEFAULT_DELIVERY_ATTEMPTS,
+		InitialBackoff: DEFAULT_INITIAL_BACKOFF,
+		MaxBackoff:     DEFAULT_MAX_BACKOFF,
+		MaxRetryAfter:  DEFAULT_MAX_RETRY_AFTER,
+	}
+}
+
+// Send posts body, retrying transient failures with jittered exponential backoff.
+// The returned error is a *DeliveryError.
+func (d *Delivery) Send(body []byte) error {
+	attempts := d.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var derr *DeliveryError
+	for attempt := 0; attempt < attempts; attempt++ {
+		derr = d.post(body)
+		if derr == nil {
+			return nil
+		}
+		if derr.Permanent || attempt == attempts-1 {
+			break
+		}
+		delay := d.backoff(attempt)
+		if derr.RetryAfter > 0 {
+			if derr.RetryAfter > d.MaxRetryAfter {
+				log.Printf("Server asked to retry after %v, giving up", derr.RetryAfter)
+				break
+			}
+			delay = derr.RetryAfter
+		}
+		log.Printf("%v, retrying in %v", derr, delay)
+		time.Sleep(delay)
+	}
+	return derr
+}
+
+// full jitter: a random delay in [0, min(MaxBackoff, InitialBackoff * 2^attempt))
+func (d *Delivery) backoff(attempt int) time.Duration {
+	limit := d.InitialBackoff << uint(attempt)
+	if limit <= 0 || limit > d.MaxBackoff {
+		limit = d.MaxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+func (d *Delivery) post(body []byte) *DeliveryError {
+	req, err := http.NewRequest("POST", d.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return &DeliveryError{Permanent: true, Err: err}
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("MonitoringToken %s", d.Token))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return &DeliveryError{Err: err}
+	}
+	defer resp.Body.Close()
+	// drain so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return classifyResponse(resp)
+}
+
+func classifyResponse(resp *http.Response) *DeliveryError {
+	code := resp.StatusCode
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	derr := &DeliveryError{StatusCode: code}
+	switch {
+	case code == http.StatusRequestTimeout, code == http.StatusTooEarly,
+		code == http.StatusTooManyRequests, code >= 500:
+		derr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	default:
+		derr.Permanent = true
+	}
+	return derr
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// DeliveryExitCode maps the result of Delivery.Send, or a CollectionError,
+// to the process exit code
+func DeliveryExitCode(err error) int {
+	if err == nil {
+		return NORMAL_EXIT
+	}
+	var cerr *CollectionError
+	if errors.As(err, &cerr) {
+		return COLLECTION_FAILED
+	}
+	var derr *DeliveryError
+	if !errors.As(err, &derr) {
+		return DELIVERY_FAILED
+	}
+	if derr.IsAuthError() {
+		return AUTH_REJECTED
+	}
+	if derr.Permanent {
+		return DELIVERY_REJECTED
+	}
+	return DELIVERY_FAILED
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDelivery posts to a server answering with the given status codes in
+// turn, repeating the last one
+func testDelivery(t *testing.T, headers http.Header, codes ...int) (*Delivery, *int32) {
+	t.Helper()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "MonitoringToken secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(codes) {
+			n = len(codes)
+		}
+		for key, values := range headers {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(codes[n-1])
+	}))
+	t.Cleanup(server.Close)
+	d := NewDelivery(server.URL, "secret")
+	d.InitialBackoff = time.Millisecond
+	d.MaxBackoff = 5 * time.Millisecond
+	return d, &requests
+}
+
+func TestDeliverySend(t *testing.T) {
+	tests := []struct {
+		name         string
+		codes        []int
+		headers      http.Header
+		wantRequests int32
+		wantExit     int
+	}{
+		{"accepted", []int{200}, nil, 1, NORMAL_EXIT},
+		{"retried after server error", []int{503, 502, 204}, nil, 3, NORMAL_EXIT},
+		{"retried after rate limit", []int{429, 200}, nil, 2, NORMAL_EXIT},
+		{"gives up after max attempts", []int{500}, nil, 3, DELIVERY_FAILED},
+		{"bad request is not retried", []int{400}, nil, 1, DELIVERY_REJECTED},
+		{"rejected token is not retried", []int{401}, nil, 1, AUTH_REJECTED},
+		{"forbidden is not retried", []int{403}, nil, 1, AUTH_REJECTED},
+		{"retry after above the limit", []int{503}, http.Header{"Retry-After": {"3600"}}, 1, DELIVERY_FAILED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, requests := testDelivery(t, tt.headers, tt.codes...)
+			d.MaxAttempts = 3
+			err := d.Send([]byte(`{}`))
+			if *requests != tt.wantRequests {
+				t.Errorf("sent %d requests, want %d", *requests, tt.wantRequests)
+			}
+			if got := DeliveryExitCode(err); got != tt.wantExit {
+				t.Errorf("DeliveryExitCode(%v) = %d, want %d", err, got, tt.wantExit)
+			}
+			var derr *DeliveryError
+			if err != nil && !errors.As(err, &derr) {
+				t.Errorf("Send() error %T is not a *DeliveryError", err)
+			}
+		})
+	}
+}
+
+func TestDeliveryHonoursRetryAfter(t *testing.T) {
+	d, requests := testDelivery(t, http.Header{"Retry-After": {"1"}}, 503, 200)
+	start := time.Now()
+	if err := d.Send([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least the 1s Retry-After", elapsed)
+	}
+	if *requests != 2 {
+		t.Errorf("sent %d requests, want 2", *requests)
+	}
+}
+
+func TestDeliveryConnectionError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	d := NewDelivery(server.URL, "secret")
+	d.InitialBackoff = time.Millisecond
+	d.MaxAttempts = 2
+	err := d.Send([]byte(`{}`))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || derr.Permanent {
+		t.Errorf("Send() = %v, want a transient *DeliveryError", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	d := &Delivery{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		limit   time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		// the shift overflows
+		{80, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := d.backoff(tt.attempt); got < 0 || got >= tt.limit {
+				t.Fatalf("backoff(%d) = %v, want in [0, %v)", tt.attempt, got, tt.limit)
+			}
+		}
+	}
+}
+
+func TestDeliveryExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, NORMAL_EXIT},
+		{&DeliveryError{StatusCode: 503}, DELIVERY_FAILED},
+		{&DeliveryError{StatusCode: 400, Permanent: true}, DELIVERY_REJECTED},
+		{&DeliveryError{StatusCode: 401, Permanent: true}, AUTH_REJECTED},
+		{&CollectionError{Err: errors.New("no cpu")}, COLLECTION_FAILED},
+		{errors.New("unexpected"), DELIVERY_FAILED},
+	}
+	for _, tt := range tests {
+		code := DeliveryExitCode(tt.err)
+		if code != tt.want {
+			t.Errorf("DeliveryExitCode(%v) = %d, want %d", tt.err, code, tt.want)
+		}
+		if code != NORMAL_EXIT && !IsDeliveryExitCode(code) {
+			t.Errorf("IsDeliveryExitCode(%d) = false", code)
+		}
+	}
+}
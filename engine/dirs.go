@@ -22,3 +22,7 @@ func GetUpdaterDir() string {
 	return path.Join(workDir, "updates")
 }
 
+
+func GetOutboxDir() string {
+	return path.Join(workDir, "outbox")
+}
@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"github.com/shirou/gopsutil/v3/disk"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DISK_IO_SAMPLE_KEY = "diskIOSample"
+
+// devices without a backing volume
+var pseudoBlockDevicePrefixes = []string{"loop", "ram", "zram", "sr", "fd"}
+
+// DiskIOStats holds the IO counters of one block device since boot
+type DiskIOStats struct {
+	Name string `json:"name"`
+	// whole disk of a partition
+	Disk string `json:"disk,omitempty"`
+	// mount points from stat.disk.usage on this device
+	Mounts     []string `json:"mounts,omitempty"`
+	Reads      uint64   `json:"reads"`
+	Writes     uint64   `json:"writes"`
+	ReadBytes  uint64   `json:"read_bytes"`
+	WriteBytes uint64   `json:"write_bytes"`
+	InProgress uint64   `json:"in_progress"`
+	// since the previous collection, omitted on the first collection and
+	// after a reboot
+	Rates *DiskIORates `json:"rates,omitempty"`
+}
+
+// DiskIORates are averages over the time since the previous collection
+type DiskIORates struct {
+	ReadIops         float64 `json:"read_iops"`
+	WriteIops        float64 `json:"write_iops"`
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+	// milliseconds per completed request
+	ReadLatency  float64 `json:"read_latency_ms"`
+	WriteLatency float64 `json:"write_latency_ms"`
+	// average number of requests in flight
+	QueueDepth float64 `json:"queue_depth"`
+	// percent of the time the device was busy
+	Utilization float64 `json:"utilization"`
+}
+
+func isPseudoBlockDevice(name string) bool {
+	for _, prefix := range pseudoBlockDevicePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parentDisk returns the whole disk of a partition, e.g. nvme0n1 for
+// nvme0n1p1, or an empty string for whole disks
+func parentDisk(name string) string {
+	if _, err := os.Stat(hostSysPath("class", "block", name, "partition")); err != nil {
+		return ""
+	}
+	resolved, err := filepath.EvalSymlinks(hostSysPath("class", "block", name))
+	if err != nil {
+		return ""
+	}
+	return path.Base(path.Dir(resolved))
+}
+
+// blockDeviceName maps a mounted device like /dev/mapper/vg-root to its
+// kernel name dm-0. /dev/root, named so after the root= kernel argument,
+// usually has no device node and is resolved through the device number of
+// its mount point.
+func blockDeviceName(device string, mountpoint string) string {
+	if device == "/dev/root" {
+		if name := mountedDeviceName(mountpoint); len(name) > 0 {
+			return name
+		}
+	}
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	return path.Base(device)
+}
+
+// mountedDeviceName looks up the major:minor number of a mount point in
+// mountinfo and returns the kernel name of that block device
+func mountedDeviceName(mountpoint string) string {
+	data, err := ioutil.ReadFile(hostProcPath("self", "mountinfo"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// 22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/root rw
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != mountpoint {
+			continue
+		}
+		resolved, err := os.Readlink(hostSysPath("dev", "block", fields[2]))
+		if err != nil {
+			return ""
+		}
+		return path.Base(resolved)
+	}
+	return ""
+}
+
+// mountsByDevice returns the mount points by kernel device name
+func mountsByDevice() map[string][]string {
+	result := make(map[string][]string)
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return result
+	}
+	for _, p := range partitions {
+		name := blockDeviceName(p.Device, p.Mountpoint)
+		result[name] = append(result[name], p.Mountpoint)
+	}
+	return result
+}
+
+func getDiskIO(ctx *FetcherContext, result *MachineStats) error {
+	counters, err := disk.IOCounters()
+	if err != nil {
+		// not worth losing the rest of the sample over
+		log.Printf("Failed to read disk IO counters: %v", err)
+		return nil
+	}
+	mounts := mountsByDevice()
+	previous := loadCounterSample(ctx, DISK_IO_SAMPLE_KEY)
+	sample := newCounterSample()
+	for name, c := range counters {
+		if isPseudoBlockDevice(name) {
+			continue
+		}
+		sample.set(name, "reads", c.ReadCount)
+		sample.set(name, "writes", c.WriteCount)
+		sample.set(name, "read_bytes", c.ReadBytes)
+		sample.set(name, "write_bytes", c.WriteBytes)
+		sample.set(name, "read_time", c.ReadTime)
+		sample.set(name, "write_time", c.WriteTime)
+		sample.set(name, "io_time", c.IoTime)
+		sample.set(name, "weighted_io", c.WeightedIO)
+		stats := DiskIOStats{
+			Name:       name,
+			Disk:       parentDisk(name),
+			Mounts:     mounts[name],
+			Reads:      c.ReadCount,
+			Writes:     c.WriteCount,
+			ReadBytes:  c.ReadBytes,
+			WriteBytes: c.WriteBytes,
+			InProgress: c.IopsInProgress,
+		}
+		stats.Rates = diskIORates(sample, previous, name)
+		result.DiskIO = append(result.DiskIO, stats)
+	}
+	sort.Slice(result.DiskIO, func(i, j int) bool { return result.DiskIO[i].Name < result.DiskIO[j].Name })
+	storeCounterSample(ctx, DISK_IO_SAMPLE_KEY, sample)
+	return nil
+}
+
+// diskIORates computes the rates of one device like iostat -x, or returns
+// nil when a counter went backwards or there is no previous sample
+func diskIORates(sample *counterSample, previous *counterSample, name string) *DiskIORates {
+	seconds, ok := sample.elapsed(previous)
+	if !ok {
+		return nil
+	}
+	deltas := make(map[string]float64)
+	for _, counter := range []string{"reads", "writes", "read_bytes", "write_bytes", "read_time", "write_time", "io_time", "weighted_io"} {
+		delta, ok := sample.delta(previous, name, counter)
+		if !ok {
+			return nil
+		}
+		deltas[counter] = float64(delta)
+	}
+	latency := func(time float64, requests float64) float64 {
+		if requests == 0 {
+			return 0
+		}
+		return time / requests
+	}
+	// the time counters are in milliseconds
+	millis := seconds * 1000
+	rates := &DiskIORates{
+		ReadIops:         deltas["reads"] / seconds,
+		WriteIops:        deltas["writes"] / seconds,
+		ReadBytesPerSec:  deltas["read_bytes"] / seconds,
+		WriteBytesPerSec: deltas["write_bytes"] / seconds,
+		ReadLatency:      latency(deltas["read_time"], deltas["reads"]),
+		WriteLatency:     latency(deltas["write_time"], deltas["writes"]),
+		QueueDepth:       deltas["weighted_io"] / millis,
+		Utilization:      100 * deltas["io_time"] / millis,
+	}
+	if rates.Utilization > 100 {
+		rates.Utilization = 100
+	}
+	return rates
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"path"
+	"strings"
+)
+
+var dmiDir = "/sys/class/dmi/id"
+
+// dmiInfo holds the SMBIOS strings that reveal the hypervisor vendor. They
+// are world readable, unlike product_uuid and product_serial.
+type dmiInfo struct {
+	SysVendor       string
+	ProductName     string
+	ProductVersion  string
+	BiosVendor      string
+	BiosVersion     string
+	BoardAssetTag   string
+	ChassisAssetTag string
+}
+
+func readDMI() dmiInfo {
+	read := func(name string) string {
+		return readTrimmed(path.Join(dmiDir, name))
+	}
+	return dmiInfo{
+		SysVendor:       read("sys_vendor"),
+		ProductName:     read("product_name"),
+		ProductVersion:  read("product_version"),
+		BiosVendor:      read("bios_vendor"),
+		BiosVersion:     read("bios_version"),
+		BoardAssetTag:   read("board_asset_tag"),
+		ChassisAssetTag: read("chassis_asset_tag"),
+	}
+}
+
+// every Azure VM carries this chassis asset tag
+const AZURE_CHASSIS_ASSET_TAG = "7783-7084-3265-9085-8269-3286-77"
+
+// cloud labels reported for provider names
+var cloudLabels = map[string]string{
+	"aws":          "AWS",
+	"gcp":          "GCP",
+	"azure":        "Azure",
+	"digitalocean": "DigitalOcean",
+	"hetzner":      "Hetzner",
+	"openstack":    "OpenStack",
+	"oci":          "OCI",
+	"linode":       "Linode",
+	"vultr":        "Vultr",
+	"alibaba":      "Alibaba",
+}
+
+// cloud returns the provider name the DMI strings point to, or an empty string
+func (d dmiInfo) cloud() string {
+	has := func(value string, s string) bool {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(s))
+	}
+	switch {
+	case has(d.SysVendor, "Amazon EC2") || has(d.BiosVendor, "Amazon EC2") ||
+		has(d.BiosVersion, "amazon") || has(d.ProductVersion, "amazon"):
+		return "aws"
+	case has(d.ProductName, "Google Compute Engine") || d.SysVendor == "Google":
+		return "gcp"
+	case d.ChassisAssetTag == AZURE_CHASSIS_ASSET_TAG:
+		return "azure"
+	case has(d.SysVendor, "DigitalOcean"):
+		return "digitalocean"
+	case has(d.SysVendor, "Hetzner"):
+		return "hetzner"
+	case has(d.ChassisAssetTag, "OracleCloud.com"):
+		return "oci"
+	case has(d.SysVendor, "Linode") || has(d.SysVendor, "Akamai"):
+		return "linode"
+	case has(d.SysVendor, "Vultr"):
+		return "vultr"
+	case has(d.SysVendor, "Alibaba Cloud"):
+		return "alibaba"
+	case has(d.ProductName, "OpenStack") || has(d.SysVendor, "OpenStack"):
+		return "openstack"
+	}
+	return ""
+}
+
+// dmiInstanceID identifies the machine from DMI alone, for hosts whose
+// metadata service is firewalled. Nitro instances expose the instance id
+// as board asset tag, elsewhere the host fingerprint is used.
+func dmiInstanceID(d dmiInfo, provider string) *InstanceID {
+	result, _ := onPrem()
+	result.Cloud = cloudLabels[provider]
+	if provider == "aws" && strings.HasPrefix(d.BoardAssetTag, "i-") {
+		result.Id = d.BoardAssetTag
+		result.fallback = false
+	}
+	return result
+}
@@ -1,5 +1,37 @@
 package engine
 
+import "fmt"
+
 const (
 	NORMAL_EXIT = 0
+	// RESTART_EXIT is returned by a supervised daemon after it installed an update
+	RESTART_EXIT = 3
+	// DELIVERY_FAILED: the endpoint stayed unreachable after all retries
+	DELIVERY_FAILED = 4
+	// DELIVERY_REJECTED: the endpoint permanently rejected the payload
+	DELIVERY_REJECTED = 5
+	// AUTH_REJECTED: the endpoint rejected the security token
+	AUTH_REJECTED = 6
+	// COLLECTION_FAILED: no sample could be collected
+	COLLECTION_FAILED = 7
 )
+
+// CollectionError reports that no sample could be collected, so there was
+// nothing to deliver
+type CollectionError struct {
+	Err error
+}
+
+func (e *CollectionError) Error() string {
+	return fmt.Sprintf("failed to collect data: %v", e.Err)
+}
+
+func (e *CollectionError) Unwrap() error {
+	return e.Err
+}
+
+// IsDeliveryExitCode reports whether code was produced by DeliveryExitCode
+func IsDeliveryExitCode(code int) bool {
+	return code == DELIVERY_FAILED || code == DELIVERY_REJECTED || code == AUTH_REJECTED ||
+		code == COLLECTION_FAILED
+}
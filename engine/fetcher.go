@@ -1,20 +1,33 @@
 package engine
 
 import (
-	"encoding/json"
 	"github.com/peterbourgon/diskv"
 	"time"
 )
 
+// PAYLOAD_SCHEMA_VERSION is bumped whenever the payload layout changes
+const PAYLOAD_SCHEMA_VERSION = 14
+
 type InstanceInfo struct {
+	SchemaVersion int `json:"schema_version"`
 	Version string `json:"version"`
 	LocalTime int64 `json:"local_time"`
 	Instance InstanceID `json:"instance"`
+	// set on the first sample after the cached identity turned out to be stale
+	IdentityChange *IdentityChange `json:"identity_change,omitempty"`
+	// set on the sample pushed when the instance is about to be interrupted
+	Interruption *InterruptionNotice `json:"interruption,omitempty"`
+	// set when the agent runs in a Kubernetes pod
+	Kubernetes *KubernetesInfo `json:"kubernetes,omitempty"`
+	// set when the agent runs in a container
+	Container *ContainerInfo `json:"container,omitempty"`
 	Stat MachineStats `json:"stat"`
 }
 
 type FetcherContext struct {
 	diskv *diskv.Diskv
+	// the cached identity has been revalidated by this process
+	identityChecked bool
 }
 
 func InitFetcher(storagePath string) FetcherContext {
@@ -51,31 +64,32 @@ func SetLatestApplication(ctx *FetcherContext, path string) error {
 
 func Fetch(ctx *FetcherContext, ver string) (*InstanceInfo, error) {
 	var err error
-	var data []byte
 	var result InstanceInfo
+	result.SchemaVersion = PAYLOAD_SCHEMA_VERSION
 	result.Version = ver
 	result.LocalTime = time.Now().Unix()
-	if ctx.diskv.Has(INSTANCE_ID_KEY) {
-		data, err = ctx.diskv.Read(INSTANCE_ID_KEY)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(data, &result.Instance)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		instId := GetInstanceID()
-		if instId != nil {
-			result.Instance = *instId
-			data, err = json.MarshalIndent(result.Instance, "", " ")
-			if err == nil {
-				ctx.diskv.Write(INSTANCE_ID_KEY, data)
-			}
-		}
+	result.Instance, result.IdentityChange, err = resolveInstanceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the public address changes without a reboot, e.g. when an elastic IP
+	// is attached, so it is not cached. Unless the identity was just fetched
+	// it is read again on every collection, on its own.
+	if cloudConfig.ReportPublicIp && len(result.Instance.PublicAddr) == 0 {
+		result.Instance.PublicAddr = fetchPublicAddr(&result.Instance)
 	}
+	// tags may change without a reboot; the filter may also have been
+	// narrowed since they were cached
+	tags := currentTags(ctx, &result.Instance)
+	result.Instance.Tags = filterTags(tags)
+	// addresses may change without a reboot, so they are never taken from the cache
+	result.Instance.Addr = getOutboundIP()
+	result.Instance.Addresses = getAddresses()
+	// the cluster name may come from tags cloud.tags does not send
+	result.Kubernetes = getKubernetesInfo(tags)
+	result.Container = currentContainer
 	var stats *MachineStats
-	stats, err = GetMachineStats()
+	stats, err = GetMachineStats(ctx)
 	if err != nil {
 		return nil, err
 	}
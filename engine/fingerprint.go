@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/shirou/gopsutil/v3/host"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const CLOUD_ON_PREM = "OnPrem"
+
+var (
+	machineIdFile   = "/etc/machine-id"
+	productUuidFile = "/sys/class/dmi/id/product_uuid"
+)
+
+// interfaces that never identify the machine
+var virtualInterfacePrefixes = []string{"lo", "docker", "veth", "br-", "virbr", "cni", "flannel", "cali", "tun", "tap", "vboxnet", "vmnet"}
+
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func readTrimmed(fileName string) string {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// primaryMAC returns the hardware address of the physical interface with the
+// lowest index
+func primaryMAC() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	sort.Slice(interfaces, func(i, j int) bool { return interfaces[i].Index < interfaces[j].Index })
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+		return iface.HardwareAddr.String()
+	}
+	return ""
+}
+
+// hostFingerprint derives a stable identity from machine-id, the DMI product
+// UUID and the primary MAC. Only the hash leaves the machine. Containers get
+// a new veth MAC whenever they are recreated, so there the MAC is left out.
+func hostFingerprint() string {
+	machineId := readTrimmed(machineIdFile)
+	productUuid := strings.ToLower(readTrimmed(productUuidFile))
+	parts := []string{"machine-id=" + machineId, "product-uuid=" + productUuid}
+	mac := ""
+	if detectContainer() == nil {
+		mac = primaryMAC()
+		parts = append(parts, "mac="+mac)
+	}
+	// gopsutil falls back to the boot id on Linux, which changes on reboot
+	if runtime.GOOS != "linux" {
+		if hostId, err := host.HostID(); err == nil {
+			parts = append(parts, "host-id="+hostId)
+		}
+	}
+	if len(machineId) == 0 && len(productUuid) == 0 && len(mac) == 0 {
+		hostname, _ := os.Hostname()
+		parts = append(parts, "hostname="+hostname)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// onPrem is the last resort when no cloud provider answers
+func onPrem() (*InstanceID, error) {
+	return &InstanceID{Id: hostFingerprint()[:32], Cloud: CLOUD_ON_PREM, fallback: true}, nil
+}
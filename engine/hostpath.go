@@ -0,0 +1,24 @@
+package engine
+
+import (
+	"os"
+	"path"
+)
+
+// hostSysPath joins elem to the host's /sys, HOST_SYS lets a container see it
+func hostSysPath(elem ...string) string {
+	root := os.Getenv("HOST_SYS")
+	if len(root) == 0 {
+		root = "/sys"
+	}
+	return path.Join(append([]string{root}, elem...)...)
+}
+
+// hostProcPath joins elem to the host's /proc, honouring HOST_PROC like gopsutil
+func hostProcPath(elem ...string) string {
+	root := os.Getenv("HOST_PROC")
+	if len(root) == 0 {
+		root = "/proc"
+	}
+	return path.Join(append([]string{root}, elem...)...)
+}
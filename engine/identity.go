@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/shirou/gopsutil/v3/host"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// schema version the cached instance id was written with
+	INSTANCE_SCHEMA_KEY = "instanceSchema"
+	// host fingerprint and boot time seen when the cached instance id was validated
+	INSTANCE_FINGERPRINT_KEY = "instanceFingerprint"
+	INSTANCE_BOOT_KEY        = "instanceBootTime"
+	// tags are cached apart from the identity, see currentTags
+	INSTANCE_TAGS_KEY = "instanceTags"
+)
+
+// IDENTITY_SCHEMA_VERSION is bumped when the cached identity must be fetched
+// again, e.g. because an InstanceID field is filled from new metadata. It
+// started out at the payload schema version of its time, other payload
+// changes do not touch it.
+const IDENTITY_SCHEMA_VERSION = 14
+
+// tags change while the instance runs, so they are read from the metadata
+// service again once the cached copy is older than this
+const DEFAULT_TAGS_TTL = 15 * time.Minute
+
+const (
+	// the host fingerprint changed, the cache came with a cloned disk or image
+	IDENTITY_CLONED = "cloned"
+	// same host fingerprint, but the metadata service reports another instance
+	IDENTITY_REPLACED = "replaced"
+)
+
+// IdentityChange reports that the cached identity no longer matched the machine
+type IdentityChange struct {
+	PreviousId    string `json:"previous_id"`
+	PreviousCloud string `json:"previous_cloud"`
+	Reason        string `json:"reason"`
+}
+
+// identities cached before versioning was introduced report 1
+func cachedSchemaVersion(ctx *FetcherContext) int {
+	data, err := ctx.diskv.Read(INSTANCE_SCHEMA_KEY)
+	if err != nil {
+		return 1
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 1
+	}
+	return version
+}
+
+func readKey(ctx *FetcherContext, key string) string {
+	data, err := ctx.diskv.Read(key)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func bootTime() string {
+	boot, err := host.BootTime()
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatUint(boot, 10)
+}
+
+func loadInstanceID(ctx *FetcherContext) (*InstanceID, error) {
+	if !ctx.diskv.Has(INSTANCE_ID_KEY) || cachedSchemaVersion(ctx) != IDENTITY_SCHEMA_VERSION {
+		return nil, nil
+	}
+	data, err := ctx.diskv.Read(INSTANCE_ID_KEY)
+	if err != nil {
+		return nil, err
+	}
+	var cached InstanceID
+	if err = json.Unmarshal(data, &cached); err != nil {
+		return nil, err
+	}
+	// caches written before the public address was left out
+	cached.PublicAddr = ""
+	return &cached, nil
+}
+
+// CheckInterruption asks the metadata service of a spot instance whether it
+// is about to be interrupted. It returns nil for on-demand instances.
+func CheckInterruption(ctx *FetcherContext) (*InterruptionNotice, error) {
+	cached, err := loadInstanceID(ctx)
+	if err != nil || cached == nil || cached.Lifecycle != LIFECYCLE_SPOT {
+		return nil, err
+	}
+	watcher, ok := providerForCloud(cached.Cloud).(InterruptionWatcher)
+	if !ok {
+		return nil, nil
+	}
+	probeCtx, cancel := context.WithTimeout(context.Background(), cloudConfig.Timeout)
+	defer cancel()
+	return watcher.Interruption(probeCtx)
+}
+
+func storeInstanceID(ctx *FetcherContext, id *InstanceID, fingerprint string, boot string) {
+	// read again on every collection, see Fetch
+	cached := *id
+	cached.PublicAddr = ""
+	data, err := json.MarshalIndent(&cached, "", " ")
+	if err != nil {
+		return
+	}
+	ctx.diskv.Write(INSTANCE_ID_KEY, data)
+	ctx.diskv.Write(INSTANCE_SCHEMA_KEY, []byte(strconv.Itoa(IDENTITY_SCHEMA_VERSION)))
+	ctx.diskv.Write(INSTANCE_FINGERPRINT_KEY, []byte(fingerprint))
+	ctx.diskv.Write(INSTANCE_BOOT_KEY, []byte(boot))
+	storeTags(ctx, id, id.Tags)
+}
+
+type cachedTags struct {
+	Id    string
+	Cloud string
+	Time  int64
+	Tags  map[string]string
+}
+
+func storeTags(ctx *FetcherContext, id *InstanceID, tags map[string]string) {
+	data, err := json.Marshal(cachedTags{Id: id.Id, Cloud: id.Cloud, Time: time.Now().Unix(), Tags: tags})
+	if err != nil {
+		return
+	}
+	ctx.diskv.Write(INSTANCE_TAGS_KEY, data)
+}
+
+// fetchLiveInstance queries the provider that reported the identity again
+func fetchLiveInstance(id *InstanceID) *InstanceID {
+	p := providerForCloud(id.Cloud)
+	if p == nil {
+		return nil
+	}
+	probeCtx, cancel := context.WithTimeout(context.Background(), cloudConfig.Timeout)
+	defer cancel()
+	live, err := p.Fetch(probeCtx)
+	if err != nil || live.Id != id.Id {
+		return nil
+	}
+	return live
+}
+
+// fetchPublicAddr reads only the public address from the provider that
+// reported the identity, "" when it has none or can not tell
+func fetchPublicAddr(id *InstanceID) string {
+	reader, ok := providerForCloud(id.Cloud).(PublicAddressReader)
+	if !ok {
+		return ""
+	}
+	probeCtx, cancel := context.WithTimeout(context.Background(), cloudConfig.Timeout)
+	defer cancel()
+	addr, err := reader.PublicAddr(probeCtx)
+	if err != nil {
+		return ""
+	}
+	return addr
+}
+
+// currentTags returns the instance tags, refreshed from the metadata service
+// every DEFAULT_TAGS_TTL. When the refresh fails the last known tags are kept
+// until the next attempt.
+func currentTags(ctx *FetcherContext, id *InstanceID) map[string]string {
+	var cached cachedTags
+	data, err := ctx.diskv.Read(INSTANCE_TAGS_KEY)
+	if err == nil && json.Unmarshal(data, &cached) == nil && cached.Id == id.Id && cached.Cloud == id.Cloud {
+		if time.Since(time.Unix(cached.Time, 0)) < DEFAULT_TAGS_TTL {
+			return cached.Tags
+		}
+	} else {
+		cached.Tags = id.Tags
+	}
+	if live := fetchLiveInstance(id); live != nil {
+		cached.Tags = storedTags(live.Tags)
+	}
+	storeTags(ctx, id, cached.Tags)
+	return cached.Tags
+}
+
+// resolveInstanceID returns the cached identity, revalidating it once per
+// process. Metadata is queried again only after a reboot or when the host
+// fingerprint changed: a machine started from an image or snapshot that
+// carries our cache always boots fresh.
+func resolveInstanceID(ctx *FetcherContext) (InstanceID, *IdentityChange, error) {
+	cached, err := loadInstanceID(ctx)
+	if err != nil {
+		return InstanceID{}, nil, err
+	}
+	if cached != nil && ctx.identityChecked {
+		return *cached, nil, nil
+	}
+
+	fingerprint := hostFingerprint()
+	boot := bootTime()
+	if cached != nil {
+		fingerprintChanged := readKey(ctx, INSTANCE_FINGERPRINT_KEY) != fingerprint
+		if !fingerprintChanged && readKey(ctx, INSTANCE_BOOT_KEY) == boot {
+			ctx.identityChecked = true
+			return *cached, nil, nil
+		}
+		live := GetInstanceID()
+		if live == nil {
+			return *cached, nil, nil
+		}
+		// a cloud instance without a metadata answer most likely lost metadata access
+		if live.fallback && cached.Cloud != CLOUD_ON_PREM && !fingerprintChanged {
+			ctx.identityChecked = true
+			return *cached, nil, nil
+		}
+		storeInstanceID(ctx, live, fingerprint, boot)
+		ctx.identityChecked = true
+		if live.Id == cached.Id && live.Cloud == cached.Cloud {
+			return *live, nil, nil
+		}
+		change := &IdentityChange{PreviousId: cached.Id, PreviousCloud: cached.Cloud, Reason: IDENTITY_REPLACED}
+		if fingerprintChanged {
+			change.Reason = IDENTITY_CLONED
+		}
+		log.Printf("Instance identity changed from %s/%s to %s/%s (%s)",
+			cached.Cloud, cached.Id, live.Cloud, live.Id, change.Reason)
+		return *live, change, nil
+	}
+
+	live := GetInstanceID()
+	if live == nil {
+		return InstanceID{}, nil, nil
+	}
+	storeInstanceID(ctx, live, fingerprint, boot)
+	ctx.identityChecked = true
+	return *live, nil, nil
+}
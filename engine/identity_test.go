@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResolveInstanceID(t *testing.T) {
+	gcpId := gcpTestMetadata["instance/id"]
+	tests := []struct {
+		name string
+		// cached identity and the fingerprint and boot time stored with it,
+		// "" for the values of this machine
+		cachedId    string
+		fingerprint string
+		boot        string
+		metadata    http.Handler
+		wantId      string
+		wantReason  string
+		wantQueries bool
+	}{
+		{"unchanged", gcpId, "", "", gcpHandler(gcpTestMetadata), gcpId, "", false},
+		{"rebooted", gcpId, "", "1", gcpHandler(gcpTestMetadata), gcpId, "", true},
+		{"replaced", "1111", "", "1", gcpHandler(gcpTestMetadata), gcpId, IDENTITY_REPLACED, true},
+		{"cloned", "1111", "0123456789abcdef", "", gcpHandler(gcpTestMetadata), gcpId, IDENTITY_CLONED, true},
+		// without a metadata answer the cached cloud identity is kept...
+		{"metadata unavailable", gcpId, "", "1", http.NotFoundHandler(), gcpId, "", true},
+		// ...unless the disk was cloned, the on-prem identity is all we have
+		{"metadata unavailable after clone", gcpId, "0123456789abcdef", "", http.NotFoundHandler(),
+			hostFingerprint()[:32], IDENTITY_CLONED, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries int32
+			useMetadataServer(t, "gcp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&queries, 1)
+				tt.metadata.ServeHTTP(w, r)
+			}))
+			ctx := InitFetcher(t.TempDir())
+			fingerprint, boot := hostFingerprint(), bootTime()
+			if len(tt.fingerprint) > 0 {
+				fingerprint = tt.fingerprint
+			}
+			if len(tt.boot) > 0 {
+				boot = tt.boot
+			}
+			storeInstanceID(&ctx, &InstanceID{Id: tt.cachedId, Cloud: "GCP"}, fingerprint, boot)
+
+			id, change, err := resolveInstanceID(&ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Id != tt.wantId {
+				t.Errorf("id = %s, want %s", id.Id, tt.wantId)
+			}
+			if got := atomic.LoadInt32(&queries) > 0; got != tt.wantQueries {
+				t.Errorf("metadata queried = %v, want %v", got, tt.wantQueries)
+			}
+			if len(tt.wantReason) == 0 {
+				if change != nil {
+					t.Errorf("change = %+v, want none", *change)
+				}
+				return
+			}
+			want := IdentityChange{PreviousId: tt.cachedId, PreviousCloud: "GCP", Reason: tt.wantReason}
+			if change == nil || !reflect.DeepEqual(*change, want) {
+				t.Errorf("change = %+v, want %+v", change, want)
+			}
+			// the new identity is cached and trusted for the rest of the process
+			if cached, _ := loadInstanceID(&ctx); cached == nil || cached.Id != tt.wantId {
+				t.Errorf("cached identity = %+v, want %s", cached, tt.wantId)
+			}
+			if _, change, _ = resolveInstanceID(&ctx); change != nil {
+				t.Errorf("change reported again: %+v", *change)
+			}
+		})
+	}
+}
+
+// payload schema bumps must not force every agent to identify again
+func TestLoadInstanceIDSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    bool
+	}{
+		{"current", strconv.Itoa(IDENTITY_SCHEMA_VERSION), true},
+		{"older", strconv.Itoa(IDENTITY_SCHEMA_VERSION - 1), false},
+		{"before versioning", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := InitFetcher(t.TempDir())
+			storeInstanceID(&ctx, &InstanceID{Id: "i-0123456789abcdef0", Cloud: "AWS"}, "", "")
+			if len(tt.version) > 0 {
+				ctx.diskv.Write(INSTANCE_SCHEMA_KEY, []byte(tt.version))
+			} else {
+				ctx.diskv.Erase(INSTANCE_SCHEMA_KEY)
+			}
+			cached, err := loadInstanceID(&ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cached != nil; got != tt.want {
+				t.Errorf("cached identity loaded = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
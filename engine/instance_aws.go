@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AWS_METADATA_URL = "http://169.254.169.254"
+
+const (
+	AWS_TOKEN_TTL_HEADER = "X-aws-ec2-metadata-token-ttl-seconds"
+	AWS_TOKEN_HEADER     = "X-aws-ec2-metadata-token"
+	AWS_TOKEN_TTL        = 6 * time.Hour
+)
+
+// the session token is reused until shortly before it expires, so the
+// interruption poll does not ask for a new one every few seconds
+var awsToken struct {
+	sync.Mutex
+	baseUrl string
+	value   string
+	expires time.Time
+}
+
+func cachedAwsToken(baseUrl string) string {
+	awsToken.Lock()
+	defer awsToken.Unlock()
+	if awsToken.baseUrl != baseUrl || time.Now().After(awsToken.expires) {
+		return ""
+	}
+	return awsToken.value
+}
+
+func storeAwsToken(baseUrl string, token string) {
+	awsToken.Lock()
+	defer awsToken.Unlock()
+	awsToken.baseUrl = baseUrl
+	awsToken.value = token
+	awsToken.expires = time.Now().Add(AWS_TOKEN_TTL - time.Minute)
+}
+
+// awsMetadata reads instance metadata with an IMDSv2 session token, or
+// without one when falling back to IMDSv1
+type awsMetadata struct {
+	ctx     context.Context
+	client  *http.Client
+	baseUrl string
+	token   string
+}
+
+func newAwsMetadata(ctx context.Context) (*awsMetadata, error) {
+	m := &awsMetadata{
+		ctx:     ctx,
+		client:  metadataClient(2 * time.Second),
+		baseUrl: metadataBaseUrl("aws", AWS_METADATA_URL) + "/latest",
+	}
+	if token := cachedAwsToken(m.baseUrl); len(token) > 0 {
+		m.token = token
+		return m, nil
+	}
+	token, err := m.requestToken()
+	if err == nil {
+		m.token = token
+		storeAwsToken(m.baseUrl, token)
+		return m, nil
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// the token response is dropped when it needs more hops than the
+		// instance allows, which happens inside containers with the default
+		// limit of 1. A plain GET still gets through and tells us we are on AWS.
+		_, errV1 := m.get("meta-data/")
+		var statusErr *metadataStatusError
+		if errV1 == nil || (errors.As(errV1, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized) {
+			log.Printf("IMDSv2 token request timed out, if running in a container " +
+				"raise the instance metadata hop limit (HttpPutResponseHopLimit) to 2")
+		}
+	}
+	if !cloudConfig.AwsImdsV1Fallback {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *awsMetadata) requestToken() (string, error) {
+	// keep time for the fallback checks when the response never arrives
+	ctx, cancel := context.WithTimeout(m.ctx, time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", m.baseUrl+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(AWS_TOKEN_TTL_HEADER, strconv.Itoa(int(AWS_TOKEN_TTL.Seconds())))
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("IMDSv2 token request failed with status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (m *awsMetadata) get(item string) (string, error) {
+	var headers map[string]string
+	if len(m.token) > 0 {
+		headers = map[string]string{AWS_TOKEN_HEADER: m.token}
+	}
+	body, err := metadataGet(m.ctx, m.client, m.baseUrl+"/"+item, headers)
+	var statusErr *metadataStatusError
+	if len(m.token) > 0 && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+		// the token was revoked, get a fresh one next time
+		storeAwsToken("", "")
+	}
+	return body, err
+}
+
+type awsInstanceAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
+
+// spot/instance-action appears about two minutes before the interruption
+func (p *awsProvider) Interruption(ctx context.Context) (*InterruptionNotice, error) {
+	m, err := newAwsMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := m.get("meta-data/spot/instance-action")
+	var statusErr *metadataStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var action awsInstanceAction
+	if err = json.Unmarshal([]byte(body), &action); err != nil {
+		return nil, err
+	}
+	return &InterruptionNotice{Cloud: "AWS", Action: action.Action, Time: action.Time}, nil
+}
+
+// block-device-mapping names the root device, the EBS volumes attached at
+// launch and the instance store volumes. Volume ids are only known from the
+// NVMe serials of Nitro instances.
+func (p *awsProvider) Volumes(ctx context.Context) (map[string]VolumeInfo, error) {
+	m, err := newAwsMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := m.get("meta-data/block-device-mapping/")
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]VolumeInfo)
+	for _, entry := range strings.Fields(entries) {
+		device, err := m.get("meta-data/block-device-mapping/" + entry)
+		if err != nil {
+			continue
+		}
+		volumeType := VOLUME_EBS
+		if strings.HasPrefix(entry, "ephemeral") {
+			volumeType = VOLUME_INSTANCE_STORE
+		}
+		for _, name := range awsDiskNames(device) {
+			result[name] = VolumeInfo{Type: volumeType}
+		}
+	}
+	return result, nil
+}
+
+// awsDiskNames returns the kernel names a mapped device may have: /dev/sda1
+// is a partition of sda, and sd devices show up as xvd on Xen instances
+func awsDiskNames(device string) []string {
+	name := strings.TrimRight(strings.TrimPrefix(device, "/dev/"), "0123456789")
+	names := []string{name}
+	if strings.HasPrefix(name, "sd") {
+		names = append(names, "xvd"+name[2:])
+	}
+	return names
+}
+
+type awsIdentityDocument struct {
+	AccountId        string `json:"accountId"`
+	InstanceId       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	ImageId          string `json:"imageId"`
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availabilityZone"`
+}
+
+type awsProvider struct{}
+
+func (p *awsProvider) Name() string {
+	return "aws"
+}
+
+// without a token the metadata service answers 401 when IMDSv1 is disabled
+func (p *awsProvider) Detect(ctx context.Context) bool {
+	probeUrl := metadataBaseUrl(p.Name(), AWS_METADATA_URL) + "/latest/meta-data/"
+	status, _, err := metadataProbe(ctx, metadataClient(2*time.Second), probeUrl, nil)
+	return err == nil && (status == 200 || status == http.StatusUnauthorized)
+}
+
+func (p *awsProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	m, err := newAwsMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := m.get("dynamic/instance-identity/document")
+	if err != nil {
+		return nil, err
+	}
+	var doc awsIdentityDocument
+	if err = json.Unmarshal([]byte(body), &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.InstanceId) == 0 {
+		return nil, errors.New("AWS identity document has no instanceId")
+	}
+	result := &InstanceID{
+		Id:           doc.InstanceId,
+		Cloud:        "AWS",
+		Account:      doc.AccountId,
+		Region:       doc.Region,
+		Zone:         doc.AvailabilityZone,
+		InstanceType: doc.InstanceType,
+		ImageId:      doc.ImageId,
+		Lifecycle:    LIFECYCLE_ON_DEMAND,
+	}
+	// "spot", "on-demand" or "scheduled"
+	if lifecycle, err := m.get("meta-data/instance-life-cycle"); err == nil && lifecycle == "spot" {
+		result.Lifecycle = LIFECYCLE_SPOT
+	}
+	if cloudConfig.ReportPublicIp {
+		// 404 when the instance has no public address
+		result.PublicAddr, _ = m.get("meta-data/public-ipv4")
+	}
+	result.Tags = m.tags()
+	return result, nil
+}
+
+// 404 when the instance has no public address
+func (p *awsProvider) PublicAddr(ctx context.Context) (string, error) {
+	m, err := newAwsMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	return optionalMetadata(m.get("meta-data/public-ipv4"))
+}
+
+// tags are only exposed when "Allow tags in instance metadata" is enabled,
+// otherwise tags/instance answers 404
+func (m *awsMetadata) tags() map[string]string {
+	keys, err := m.get("meta-data/tags/instance")
+	if err != nil || len(keys) == 0 {
+		return nil
+	}
+	tags := make(map[string]string)
+	for _, key := range strings.Split(keys, "\n") {
+		key = strings.TrimSpace(key)
+		if len(key) == 0 || !tagStored(key) {
+			continue
+		}
+		if value, err := m.get("meta-data/tags/instance/" + url.PathEscape(key)); err == nil {
+			tags[key] = value
+		}
+	}
+	return tags
+}
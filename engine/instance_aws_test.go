@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const awsTestToken = "AQAEAJ3qkA=="
+
+var awsTestMetadata = map[string]string{
+	"dynamic/instance-identity/document": `{
+  "accountId": "123456789012",
+  "instanceId": "i-0123456789abcdef0",
+  "instanceType": "m5.large",
+  "imageId": "ami-0abcdef1234567890",
+  "region": "eu-west-1",
+  "availabilityZone": "eu-west-1b"
+}`,
+	"meta-data/":                    "ami-id\ninstance-id\n",
+	"meta-data/instance-life-cycle": "spot",
+	"meta-data/public-ipv4":         "54.1.2.3",
+	"meta-data/tags/instance":       "Name\nenv",
+	"meta-data/tags/instance/Name":  "web-1",
+	"meta-data/tags/instance/env":   "prod",
+}
+
+// awsHandler serves IMDSv2 and counts the session tokens handed out. With
+// v1 set plain requests without a token are answered too.
+func awsHandler(tokens *int32, v1 bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			if r.Header.Get(AWS_TOKEN_TTL_HEADER) == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			atomic.AddInt32(tokens, 1)
+			w.Write([]byte(awsTestToken))
+			return
+		}
+		if r.Header.Get(AWS_TOKEN_HEADER) != awsTestToken && !v1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		value, ok := awsTestMetadata[strings.TrimPrefix(r.URL.Path, "/latest/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	})
+}
+
+func resetAwsToken() {
+	storeAwsToken("", "")
+}
+
+func TestAwsDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		v1   bool
+	}{
+		{"IMDSv2 only", false},
+		{"IMDSv1 allowed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokens int32
+			useMetadataServer(t, "aws", awsHandler(&tokens, tt.v1))
+			if !(&awsProvider{}).Detect(context.Background()) {
+				t.Error("Detect() = false on IMDS")
+			}
+		})
+	}
+}
+
+func TestAwsFetch(t *testing.T) {
+	resetAwsToken()
+	var tokens int32
+	useMetadataServer(t, "aws", awsHandler(&tokens, false))
+	cloudConfig.ReportPublicIp = true
+
+	id, err := (&awsProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:           "i-0123456789abcdef0",
+		Cloud:        "AWS",
+		Account:      "123456789012",
+		Region:       "eu-west-1",
+		Zone:         "eu-west-1b",
+		InstanceType: "m5.large",
+		ImageId:      "ami-0abcdef1234567890",
+		Lifecycle:    LIFECYCLE_SPOT,
+		PublicAddr:   "54.1.2.3",
+		Tags:         map[string]string{"Name": "web-1", "env": "prod"},
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+
+}
+
+func TestAwsPublicAddr(t *testing.T) {
+	resetAwsToken()
+	var tokens int32
+	useMetadataServer(t, "aws", awsHandler(&tokens, false))
+
+	addr, err := (&awsProvider{}).PublicAddr(context.Background())
+	if err != nil || addr != "54.1.2.3" {
+		t.Errorf("PublicAddr() = %q, %v, want 54.1.2.3", addr, err)
+	}
+
+	delete(awsTestMetadata, "meta-data/public-ipv4")
+	defer func() { awsTestMetadata["meta-data/public-ipv4"] = "54.1.2.3" }()
+	addr, err = (&awsProvider{}).PublicAddr(context.Background())
+	if err != nil || addr != "" {
+		t.Errorf("PublicAddr() without address = %q, %v, want no address", addr, err)
+	}
+}
+
+// the interruption poll must not ask for a token every few seconds
+func TestAwsTokenReuse(t *testing.T) {
+	resetAwsToken()
+	var tokens int32
+	useMetadataServer(t, "aws", awsHandler(&tokens, false))
+	if _, err := (&awsProvider{}).Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := (&awsProvider{}).Interruption(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("requested %d session tokens, want 1", tokens)
+	}
+}
+
+func TestAwsFetchWithoutToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		v1Fallback bool
+		wantErr    bool
+	}{
+		{"v1 fallback disabled", false, true},
+		{"v1 fallback enabled", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetAwsToken()
+			useMetadataServer(t, "aws", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "PUT" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				var tokens int32
+				awsHandler(&tokens, true).ServeHTTP(w, r)
+			}))
+			cloudConfig.AwsImdsV1Fallback = tt.v1Fallback
+			id, err := (&awsProvider{}).Fetch(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Fetch() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && id.Id != "i-0123456789abcdef0" {
+				t.Errorf("Fetch() id = %q", id.Id)
+			}
+		})
+	}
+}
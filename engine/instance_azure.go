@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	AZURE_METADATA_URL = "http://169.254.169.254"
+	AZURE_API_VERSION  = "2021-02-01"
+)
+
+var azureHeaders = map[string]string{"Metadata": "true"}
+
+type azureCompute struct {
+	VmId              string `json:"vmId"`
+	SubscriptionId    string `json:"subscriptionId"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	Location          string `json:"location"`
+	Zone              string `json:"zone"`
+	VmSize            string `json:"vmSize"`
+	// Regular, Spot or Low
+	Priority       string              `json:"priority"`
+	TagsList       []azureTag          `json:"tagsList"`
+	StorageProfile azureStorageProfile `json:"storageProfile"`
+}
+
+type azureTag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type azureImageReference struct {
+	Id        string `json:"id"`
+	Publisher string `json:"publisher"`
+	Offer     string `json:"offer"`
+	Sku       string `json:"sku"`
+	Version   string `json:"version"`
+}
+
+type azureManagedDisk struct {
+	Id string `json:"id"`
+	// e.g. Premium_LRS, StandardSSD_LRS
+	StorageAccountType string `json:"storageAccountType"`
+}
+
+type azureDisk struct {
+	Lun         string           `json:"lun"`
+	Name        string           `json:"name"`
+	ManagedDisk azureManagedDisk `json:"managedDisk"`
+}
+
+// unmanaged disks only have a name
+func (d azureDisk) volume() VolumeInfo {
+	id := d.ManagedDisk.Id
+	if len(id) == 0 {
+		id = d.Name
+	}
+	return VolumeInfo{Id: id, Type: d.ManagedDisk.StorageAccountType}
+}
+
+type azureStorageProfile struct {
+	ImageReference azureImageReference `json:"imageReference"`
+	OsDisk         azureDisk           `json:"osDisk"`
+	DataDisks      []azureDisk         `json:"dataDisks"`
+}
+
+// custom images have an id, marketplace ones are publisher:offer:sku:version
+func (r azureImageReference) String() string {
+	if len(r.Id) > 0 {
+		return r.Id
+	}
+	if len(r.Publisher) == 0 {
+		return ""
+	}
+	return strings.Join([]string{r.Publisher, r.Offer, r.Sku, r.Version}, ":")
+}
+
+type azureIpAddress struct {
+	PrivateIpAddress string `json:"privateIpAddress"`
+	PublicIpAddress  string `json:"publicIpAddress"`
+}
+
+type azureInterface struct {
+	Ipv4 struct {
+		IpAddress []azureIpAddress `json:"ipAddress"`
+	} `json:"ipv4"`
+}
+
+type azureNetwork struct {
+	Interface []azureInterface `json:"interface"`
+}
+
+type azureInstance struct {
+	Compute azureCompute `json:"compute"`
+	Network azureNetwork `json:"network"`
+}
+
+func (network *azureNetwork) publicIp() string {
+	for _, iface := range network.Interface {
+		for _, addr := range iface.Ipv4.IpAddress {
+			if len(addr.PublicIpAddress) > 0 {
+				return addr.PublicIpAddress
+			}
+		}
+	}
+	return ""
+}
+
+type azureProvider struct{}
+
+func (p *azureProvider) Name() string {
+	return "azure"
+}
+
+func (p *azureProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), AZURE_METADATA_URL) + "/metadata/" + item
+}
+
+func (p *azureProvider) Detect(ctx context.Context) bool {
+	status, _, err := metadataProbe(ctx, metadataClient(2*time.Second), p.url("versions"), azureHeaders)
+	return err == nil && status == 200
+}
+
+func (p *azureProvider) instance(ctx context.Context) (*azureInstance, error) {
+	body, err := metadataGet(ctx, metadataClient(2*time.Second), p.url("instance?api-version="+AZURE_API_VERSION), azureHeaders)
+	if err != nil {
+		return nil, err
+	}
+	var instance azureInstance
+	if err = json.Unmarshal([]byte(body), &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// instance/network is the network section of the instance document alone
+func (p *azureProvider) PublicAddr(ctx context.Context) (string, error) {
+	body, err := metadataGet(ctx, metadataClient(2*time.Second), p.url("instance/network?api-version="+AZURE_API_VERSION), azureHeaders)
+	if err != nil {
+		return "", err
+	}
+	var network azureNetwork
+	if err = json.Unmarshal([]byte(body), &network); err != nil {
+		return "", err
+	}
+	return network.publicIp(), nil
+}
+
+// the Azure Linux agent links the OS disk as /dev/disk/azure/root and data
+// disks as /dev/disk/azure/scsi1/lun<N>
+func (p *azureProvider) Volumes(ctx context.Context) (map[string]VolumeInfo, error) {
+	instance, err := p.instance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	profile := instance.Compute.StorageProfile
+	result := make(map[string]VolumeInfo)
+	if name, ok := diskLinks(path.Join(devDir, "disk", "azure"))["root"]; ok {
+		result[name] = profile.OsDisk.volume()
+	}
+	luns := diskLinks(path.Join(devDir, "disk", "azure", "scsi1"))
+	for _, d := range profile.DataDisks {
+		if name, ok := luns["lun"+d.Lun]; ok {
+			result[name] = d.volume()
+		}
+	}
+	return result, nil
+}
+
+func (p *azureProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	instance, err := p.instance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	compute := instance.Compute
+	if len(compute.VmId) == 0 {
+		return nil, errors.New("Azure metadata has no vmId")
+	}
+	lifecycle := LIFECYCLE_ON_DEMAND
+	if strings.EqualFold(compute.Priority, "Spot") || strings.EqualFold(compute.Priority, "Low") {
+		lifecycle = LIFECYCLE_SPOT
+	}
+	result := &InstanceID{
+		Id:            compute.VmId,
+		Cloud:         "Azure",
+		Account:       compute.SubscriptionId,
+		ResourceGroup: compute.ResourceGroupName,
+		Region:        compute.Location,
+		Zone:          compute.Zone,
+		InstanceType:  compute.VmSize,
+		ImageId:       compute.StorageProfile.ImageReference.String(),
+		Lifecycle:     lifecycle,
+	}
+	if cloudConfig.ReportPublicIp {
+		result.PublicAddr = instance.Network.publicIp()
+	}
+	if len(compute.TagsList) > 0 {
+		result.Tags = make(map[string]string)
+		for _, tag := range compute.TagsList {
+			result.Tags[tag.Name] = tag.Value
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const azureTestInstance = `{
+ "compute": {
+  "vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+  "subscriptionId": "8d10da13-8125-4ba9-a717-bf7490507b3d",
+  "resourceGroupName": "binadox",
+  "location": "westeurope",
+  "zone": "2",
+  "vmSize": "Standard_D2s_v3",
+  "priority": "Spot",
+  "tagsList": [{"name": "env", "value": "prod"}],
+  "storageProfile": {
+   "imageReference": {"publisher": "Canonical", "offer": "UbuntuServer", "sku": "18.04-LTS", "version": "latest"}
+  }
+ },
+ "network": {"interface": [{"ipv4": {"ipAddress": [{"privateIpAddress": "10.0.0.4", "publicIpAddress": "20.1.2.3"}]}}]}
+}`
+
+// azureHandler serves IMDS and, like the real service, requires Metadata: true
+func azureHandler(t *testing.T, instance string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata/versions", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"apiVersions":["2021-02-01"]}`))
+	})
+	mux.HandleFunc("/metadata/instance", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api-version") != AZURE_API_VERSION {
+			t.Errorf("api-version = %q, want %q", r.URL.Query().Get("api-version"), AZURE_API_VERSION)
+		}
+		w.Write([]byte(instance))
+	})
+	mux.HandleFunc("/metadata/instance/network", func(w http.ResponseWriter, r *http.Request) {
+		var sections map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(instance), &sections); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(sections["network"])
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func TestAzureDetect(t *testing.T) {
+	useMetadataServer(t, "azure", azureHandler(t, azureTestInstance))
+	if !(&azureProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = false on IMDS")
+	}
+}
+
+func TestAzureFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		publicIp bool
+		want     InstanceID
+	}{
+		{"private", false, InstanceID{
+			Id:            "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+			Cloud:         "Azure",
+			Account:       "8d10da13-8125-4ba9-a717-bf7490507b3d",
+			ResourceGroup: "binadox",
+			Region:        "westeurope",
+			Zone:          "2",
+			InstanceType:  "Standard_D2s_v3",
+			ImageId:       "Canonical:UbuntuServer:18.04-LTS:latest",
+			Lifecycle:     LIFECYCLE_SPOT,
+			Tags:          map[string]string{"env": "prod"},
+		}},
+		{"public ip", true, InstanceID{
+			Id:            "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+			Cloud:         "Azure",
+			Account:       "8d10da13-8125-4ba9-a717-bf7490507b3d",
+			ResourceGroup: "binadox",
+			Region:        "westeurope",
+			Zone:          "2",
+			InstanceType:  "Standard_D2s_v3",
+			ImageId:       "Canonical:UbuntuServer:18.04-LTS:latest",
+			Lifecycle:     LIFECYCLE_SPOT,
+			PublicAddr:    "20.1.2.3",
+			Tags:          map[string]string{"env": "prod"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetadataServer(t, "azure", azureHandler(t, azureTestInstance))
+			cloudConfig.ReportPublicIp = tt.publicIp
+			id, err := (&azureProvider{}).Fetch(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*id, tt.want) {
+				t.Errorf("Fetch() = %+v, want %+v", *id, tt.want)
+			}
+		})
+	}
+}
+
+func TestAzureFetchWithoutVmId(t *testing.T) {
+	useMetadataServer(t, "azure", azureHandler(t, `{"compute": {}}`))
+	if _, err := (&azureProvider{}).Fetch(context.Background()); err == nil {
+		t.Error("Fetch() succeeded without a vmId")
+	}
+}
+
+func TestAzurePublicAddr(t *testing.T) {
+	useMetadataServer(t, "azure", azureHandler(t, azureTestInstance))
+	addr, err := (&azureProvider{}).PublicAddr(context.Background())
+	if err != nil || addr != "20.1.2.3" {
+		t.Errorf("PublicAddr() = %q, %v, want 20.1.2.3", addr, err)
+	}
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const DIGITALOCEAN_METADATA_URL = "http://169.254.169.254"
+
+type digitalOceanMetadata struct {
+	DropletId int64  `json:"droplet_id"`
+	Region    string `json:"region"`
+	// droplet tags have no values
+	Tags       []string `json:"tags"`
+	Interfaces struct {
+		Public []struct {
+			Ipv4 struct {
+				IpAddress string `json:"ip_address"`
+			} `json:"ipv4"`
+		} `json:"public"`
+	} `json:"interfaces"`
+}
+
+type digitalOceanProvider struct{}
+
+func (p *digitalOceanProvider) Name() string {
+	return "digitalocean"
+}
+
+func (p *digitalOceanProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), DIGITALOCEAN_METADATA_URL) + "/metadata/" + item
+}
+
+func (p *digitalOceanProvider) Detect(ctx context.Context) bool {
+	status, _, err := metadataProbe(ctx, metadataClient(2*time.Second), p.url("v1/id"), nil)
+	return err == nil && status == 200
+}
+
+// 404 when the droplet has no public interface
+func (p *digitalOceanProvider) PublicAddr(ctx context.Context) (string, error) {
+	return optionalMetadata(metadataGet(ctx, metadataClient(2*time.Second), p.url("v1/interfaces/public/0/ipv4/address"), nil))
+}
+
+func (p *digitalOceanProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	client := metadataClient(2 * time.Second)
+	body, err := metadataGet(ctx, client, p.url("v1.json"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata digitalOceanMetadata
+	if err = json.Unmarshal([]byte(body), &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.DropletId == 0 {
+		return nil, errors.New("DigitalOcean metadata has no droplet_id")
+	}
+	// droplet size and image are not exposed by the metadata service
+	result := &InstanceID{
+		Id:        strconv.FormatInt(metadata.DropletId, 10),
+		Cloud:     "DigitalOcean",
+		Region:    metadata.Region,
+		Lifecycle: LIFECYCLE_ON_DEMAND,
+	}
+	if cloudConfig.ReportPublicIp && len(metadata.Interfaces.Public) > 0 {
+		result.PublicAddr = metadata.Interfaces.Public[0].Ipv4.IpAddress
+	}
+	if len(metadata.Tags) > 0 {
+		result.Tags = make(map[string]string)
+		for _, tag := range metadata.Tags {
+			result.Tags[tag] = ""
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+)
+
+const GCP_METADATA_URL = "http://metadata.google.internal"
+
+var gcpHeaders = map[string]string{"Metadata-Flavor": "Google"}
+
+type gcpDisk struct {
+	DeviceName string `json:"deviceName"`
+	// PERSISTENT or SCRATCH
+	Type string `json:"type"`
+}
+
+type gcpProvider struct{}
+
+func (p *gcpProvider) Name() string {
+	return "gcp"
+}
+
+func (p *gcpProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), GCP_METADATA_URL) + "/computeMetadata/v1/" + item
+}
+
+// the metadata server tags every response with Metadata-Flavor: Google
+func (p *gcpProvider) Detect(ctx context.Context) bool {
+	status, header, err := metadataProbe(ctx, metadataClient(2*time.Second), p.url(""), gcpHeaders)
+	return err == nil && status == 200 && header.Get("Metadata-Flavor") == "Google"
+}
+
+// instance/preempted turns TRUE about 30 seconds before the instance stops
+func (p *gcpProvider) Interruption(ctx context.Context) (*InterruptionNotice, error) {
+	preempted, err := metadataGet(ctx, metadataClient(2*time.Second), p.url("instance/preempted"), gcpHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(preempted, "TRUE") {
+		return nil, nil
+	}
+	return &InterruptionNotice{Cloud: "GCP", Action: "preempt"}, nil
+}
+
+// the guest environment links every disk as /dev/disk/by-id/google-<device name>.
+// The metadata server does not tell the persistent disk name, the device
+// name only defaults to it.
+func (p *gcpProvider) Volumes(ctx context.Context) (map[string]VolumeInfo, error) {
+	body, err := metadataGet(ctx, metadataClient(2*time.Second), p.url("instance/disks/?recursive=true"), gcpHeaders)
+	if err != nil {
+		return nil, err
+	}
+	var disks []gcpDisk
+	if err = json.Unmarshal([]byte(body), &disks); err != nil {
+		return nil, err
+	}
+	links := diskLinks(path.Join(devDir, "disk", "by-id"))
+	result := make(map[string]VolumeInfo)
+	for _, d := range disks {
+		if name, ok := links["google-"+d.DeviceName]; ok {
+			result[name] = VolumeInfo{Device: d.DeviceName, Type: strings.ToLower(d.Type)}
+		}
+	}
+	return result, nil
+}
+
+// 404 when the first interface has no external address
+func (p *gcpProvider) PublicAddr(ctx context.Context) (string, error) {
+	return optionalMetadata(metadataGet(ctx, metadataClient(2*time.Second),
+		p.url("instance/network-interfaces/0/access-configs/0/external-ip"), gcpHeaders))
+}
+
+func (p *gcpProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	client := metadataClient(2 * time.Second)
+	get := func(item string) (string, error) {
+		return metadataGet(ctx, client, p.url(item), gcpHeaders)
+	}
+
+	id, err := get("instance/id")
+	if err != nil {
+		return nil, err
+	}
+	result := &InstanceID{Id: id, Cloud: "GCP"}
+	if result.Account, err = get("project/project-id"); err != nil {
+		return nil, err
+	}
+	// zone and machine type come as projects/<number>/zones/<zone>
+	zone, err := get("instance/zone")
+	if err != nil {
+		return nil, err
+	}
+	result.Zone = lastPathElement(zone)
+	// us-central1-a is in us-central1
+	if i := strings.LastIndex(result.Zone, "-"); i > 0 {
+		result.Region = result.Zone[:i]
+	}
+	machineType, err := get("instance/machine-type")
+	if err != nil {
+		return nil, err
+	}
+	result.InstanceType = lastPathElement(machineType)
+	if image, err := get("instance/image"); err == nil {
+		result.ImageId = image
+	}
+	result.Lifecycle = LIFECYCLE_ON_DEMAND
+	if preemptible, err := get("instance/scheduling/preemptible"); err == nil && strings.EqualFold(preemptible, "TRUE") {
+		result.Lifecycle = LIFECYCLE_SPOT
+	}
+	if cloudConfig.ReportPublicIp {
+		result.PublicAddr, _ = get("instance/network-interfaces/0/access-configs/0/external-ip")
+	}
+	// labels are not served by the metadata server, custom attributes are
+	if attributes, err := get("instance/attributes/?recursive=true"); err == nil {
+		var tags map[string]string
+		if json.Unmarshal([]byte(attributes), &tags) == nil {
+			result.Tags = tags
+		}
+	}
+	return result, nil
+}
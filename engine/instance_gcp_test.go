@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var gcpTestMetadata = map[string]string{
+	"instance/id":                         "4520031799277581759",
+	"project/project-id":                  "binadox-test",
+	"instance/zone":                       "projects/1234/zones/us-central1-a",
+	"instance/machine-type":               "projects/1234/machineTypes/e2-medium",
+	"instance/image":                      "projects/debian-cloud/global/images/debian-11",
+	"instance/scheduling/preemptible":     "TRUE",
+	"instance/attributes/?recursive=true": `{"env":"prod","ssh-keys":"user:ssh-rsa AAAA"}`,
+}
+
+// gcpHandler serves items below /computeMetadata/v1/ and, like the real
+// server, refuses requests without the Metadata-Flavor header
+func gcpHandler(items map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Metadata-Flavor", "Google")
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		item := strings.TrimPrefix(r.URL.RequestURI(), "/computeMetadata/v1/")
+		if item == "" {
+			w.Write([]byte("instance/\nproject/\n"))
+			return
+		}
+		value, ok := items[item]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	})
+}
+
+func TestGcpDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    bool
+	}{
+		{"metadata server", gcpHandler(gcpTestMetadata), true},
+		{"without Metadata-Flavor", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("instance/\n"))
+		}), false},
+		{"not found", http.NotFoundHandler(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetadataServer(t, "gcp", tt.handler)
+			if got := (&gcpProvider{}).Detect(context.Background()); got != tt.want {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGcpFetch(t *testing.T) {
+	useMetadataServer(t, "gcp", gcpHandler(gcpTestMetadata))
+	id, err := (&gcpProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:           "4520031799277581759",
+		Cloud:        "GCP",
+		Account:      "binadox-test",
+		Region:       "us-central1",
+		Zone:         "us-central1-a",
+		InstanceType: "e2-medium",
+		ImageId:      "projects/debian-cloud/global/images/debian-11",
+		Lifecycle:    LIFECYCLE_SPOT,
+		// filtered later, in GetInstanceID
+		Tags: map[string]string{"env": "prod", "ssh-keys": "user:ssh-rsa AAAA"},
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+}
+
+func TestGcpFetchMissingItem(t *testing.T) {
+	items := make(map[string]string)
+	for k, v := range gcpTestMetadata {
+		items[k] = v
+	}
+	delete(items, "project/project-id")
+	useMetadataServer(t, "gcp", gcpHandler(items))
+	if _, err := (&gcpProvider{}).Fetch(context.Background()); err == nil {
+		t.Error("Fetch() succeeded without a project id")
+	}
+}
+
+func TestGcpPublicAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"external address", "34.1.2.3"},
+		{"no access config", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := map[string]string{}
+			if len(tt.ip) > 0 {
+				items["instance/network-interfaces/0/access-configs/0/external-ip"] = tt.ip
+			}
+			useMetadataServer(t, "gcp", gcpHandler(items))
+			addr, err := (&gcpProvider{}).PublicAddr(context.Background())
+			if err != nil || addr != tt.ip {
+				t.Errorf("PublicAddr() = %q, %v, want %q", addr, err, tt.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"strconv"
+	"time"
+)
+
+const HETZNER_METADATA_URL = "http://169.254.169.254"
+
+// the metadata document is YAML
+type hetznerMetadata struct {
+	InstanceId       int64  `yaml:"instance-id"`
+	Hostname         string `yaml:"hostname"`
+	Region           string `yaml:"region"`
+	AvailabilityZone string `yaml:"availability-zone"`
+	PublicIpv4       string `yaml:"public-ipv4"`
+}
+
+type hetznerProvider struct{}
+
+func (p *hetznerProvider) Name() string {
+	return "hetzner"
+}
+
+func (p *hetznerProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), HETZNER_METADATA_URL) + "/hetzner/v1/" + item
+}
+
+func (p *hetznerProvider) Detect(ctx context.Context) bool {
+	status, _, err := metadataProbe(ctx, metadataClient(2*time.Second), p.url("metadata/instance-id"), nil)
+	return err == nil && status == 200
+}
+
+// every key of the metadata document is also served on its own
+func (p *hetznerProvider) PublicAddr(ctx context.Context) (string, error) {
+	return optionalMetadata(metadataGet(ctx, metadataClient(2*time.Second), p.url("metadata/public-ipv4"), nil))
+}
+
+func (p *hetznerProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	body, err := metadataGet(ctx, metadataClient(2*time.Second), p.url("metadata"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata hetznerMetadata
+	if err = yaml.Unmarshal([]byte(body), &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.InstanceId == 0 {
+		return nil, errors.New("Hetzner metadata has no instance-id")
+	}
+	// server type, image and labels are only available through the Cloud API
+	result := &InstanceID{
+		Id:        strconv.FormatInt(metadata.InstanceId, 10),
+		Cloud:     "Hetzner",
+		Region:    metadata.Region,
+		Zone:      metadata.AvailabilityZone,
+		Lifecycle: LIFECYCLE_ON_DEMAND,
+	}
+	if cloudConfig.ReportPublicIp {
+		result.PublicAddr = metadata.PublicIpv4
+	}
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const hetznerTestMetadata = `availability-zone: fsn1-dc14
+hostname: web-1
+instance-id: 12345678
+local-ipv4: ''
+public-ipv4: 95.216.1.2
+region: eu-central
+`
+
+func hetznerHandler(metadata string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hetzner/v1/metadata", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(metadata))
+	})
+	mux.HandleFunc("/hetzner/v1/metadata/instance-id", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345678"))
+	})
+	mux.HandleFunc("/hetzner/v1/metadata/public-ipv4", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("95.216.1.2"))
+	})
+	return mux
+}
+
+func TestHetznerDetect(t *testing.T) {
+	useMetadataServer(t, "hetzner", hetznerHandler(hetznerTestMetadata))
+	if !(&hetznerProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = false, want true")
+	}
+}
+
+func TestHetznerFetch(t *testing.T) {
+	useMetadataServer(t, "hetzner", hetznerHandler(hetznerTestMetadata))
+	cloudConfig.ReportPublicIp = true
+
+	id, err := (&hetznerProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:         "12345678",
+		Cloud:      "Hetzner",
+		Region:     "eu-central",
+		Zone:       "fsn1-dc14",
+		Lifecycle:  LIFECYCLE_ON_DEMAND,
+		PublicAddr: "95.216.1.2",
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+	if addr, err := (&hetznerProvider{}).PublicAddr(context.Background()); err != nil || addr != "95.216.1.2" {
+		t.Errorf("PublicAddr() = %q, %v, want 95.216.1.2", addr, err)
+	}
+}
+
+func TestHetznerFetchInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+	}{
+		{"not YAML", "instance-id: [12345678"},
+		{"without instance-id", "region: eu-central\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetadataServer(t, "hetzner", hetznerHandler(tt.metadata))
+			if _, err := (&hetznerProvider{}).Fetch(context.Background()); err == nil {
+				t.Error("Fetch() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LINODE_METADATA_URL  = "http://169.254.169.254"
+	LINODE_TOKEN_HEADER  = "Metadata-Token"
+	LINODE_EXPIRY_HEADER = "Metadata-Token-Expiry-Seconds"
+)
+
+type linodeInstance struct {
+	Id     int64    `json:"id"`
+	Label  string   `json:"label"`
+	Region string   `json:"region"`
+	Type   string   `json:"type"`
+	Tags   []string `json:"tags"`
+}
+
+type linodeIpv4 struct {
+	Ipv4 struct {
+		Public []string `json:"public"`
+	} `json:"ipv4"`
+}
+
+type linodeProvider struct{}
+
+func (p *linodeProvider) Name() string {
+	return "linode"
+}
+
+func (p *linodeProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), LINODE_METADATA_URL) + "/v1/" + item
+}
+
+// every session starts with a PUT for a short lived token
+func (p *linodeProvider) token(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", p.url("token"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(LINODE_EXPIRY_HEADER, "300")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Linode token request failed with status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (p *linodeProvider) Detect(ctx context.Context) bool {
+	token, err := p.token(ctx, metadataClient(2*time.Second))
+	return err == nil && len(token) > 0
+}
+
+func (p *linodeProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	client := metadataClient(2 * time.Second)
+	token, err := p.token(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{LINODE_TOKEN_HEADER: token, "Accept": "application/json"}
+	body, err := metadataGet(ctx, client, p.url("instance"), headers)
+	if err != nil {
+		return nil, err
+	}
+	var instance linodeInstance
+	if err = json.Unmarshal([]byte(body), &instance); err != nil {
+		return nil, err
+	}
+	if instance.Id == 0 {
+		return nil, fmt.Errorf("Linode metadata has no instance id")
+	}
+	result := &InstanceID{
+		Id:           strconv.FormatInt(instance.Id, 10),
+		Cloud:        "Linode",
+		Region:       instance.Region,
+		InstanceType: instance.Type,
+		Lifecycle:    LIFECYCLE_ON_DEMAND,
+	}
+	if len(instance.Tags) > 0 {
+		result.Tags = make(map[string]string)
+		for _, tag := range instance.Tags {
+			result.Tags[tag] = ""
+		}
+	}
+	if cloudConfig.ReportPublicIp {
+		result.PublicAddr, _ = p.publicAddr(ctx, client, headers)
+	}
+	return result, nil
+}
+
+func (p *linodeProvider) PublicAddr(ctx context.Context) (string, error) {
+	client := metadataClient(2 * time.Second)
+	token, err := p.token(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	return p.publicAddr(ctx, client, map[string]string{LINODE_TOKEN_HEADER: token, "Accept": "application/json"})
+}
+
+func (p *linodeProvider) publicAddr(ctx context.Context, client *http.Client, headers map[string]string) (string, error) {
+	body, err := metadataGet(ctx, client, p.url("network"), headers)
+	if err != nil {
+		return "", err
+	}
+	var network linodeIpv4
+	if err = json.Unmarshal([]byte(body), &network); err != nil || len(network.Ipv4.Public) == 0 {
+		return "", err
+	}
+	// addresses come in CIDR notation
+	return strings.SplitN(network.Ipv4.Public[0], "/", 2)[0], nil
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+const linodeTestToken = "0123456789abcdef"
+
+// linodeHandler hands out a token for a PUT to /v1/token and, like the real
+// service, refuses every other request without it. tokens counts the PUTs.
+func linodeHandler(tokens *int32) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/instance", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 41234567, "label": "web-1", "region": "us-east", "type": "g6-standard-2", "tags": ["prod"]}`))
+	})
+	mux.HandleFunc("/v1/network", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ipv4": {"public": ["172.105.1.2/32"], "private": []}}`))
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/token" {
+			if r.Method != "PUT" || r.Header.Get(LINODE_EXPIRY_HEADER) == "" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			atomic.AddInt32(tokens, 1)
+			w.Write([]byte(linodeTestToken))
+			return
+		}
+		if r.Header.Get(LINODE_TOKEN_HEADER) != linodeTestToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func TestLinodeDetect(t *testing.T) {
+	var tokens int32
+	useMetadataServer(t, "linode", linodeHandler(&tokens))
+	if !(&linodeProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = false, want true")
+	}
+	if tokens != 1 {
+		t.Errorf("%d token requests, want 1", tokens)
+	}
+}
+
+func TestLinodeFetch(t *testing.T) {
+	var tokens int32
+	useMetadataServer(t, "linode", linodeHandler(&tokens))
+	cloudConfig.ReportPublicIp = true
+
+	id, err := (&linodeProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:           "41234567",
+		Cloud:        "Linode",
+		Region:       "us-east",
+		InstanceType: "g6-standard-2",
+		Lifecycle:    LIFECYCLE_ON_DEMAND,
+		PublicAddr:   "172.105.1.2",
+		Tags:         map[string]string{"prod": ""},
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+	// one token is enough for the instance and network requests
+	if tokens != 1 {
+		t.Errorf("%d token requests, want 1", tokens)
+	}
+}
+
+func TestLinodeFetchWithoutToken(t *testing.T) {
+	useMetadataServer(t, "linode", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	if (&linodeProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = true, want false")
+	}
+	if _, err := (&linodeProvider{}).Fetch(context.Background()); err == nil {
+		t.Error("Fetch() without token succeeded")
+	}
+}
+
+func TestLinodePublicAddr(t *testing.T) {
+	var tokens int32
+	useMetadataServer(t, "linode", linodeHandler(&tokens))
+	if addr, err := (&linodeProvider{}).PublicAddr(context.Background()); err != nil || addr != "172.105.1.2" {
+		t.Errorf("PublicAddr() = %q, %v, want 172.105.1.2", addr, err)
+	}
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const OCI_METADATA_URL = "http://169.254.169.254"
+
+// IMDSv2 of Oracle Cloud rejects requests without this header
+var ociHeaders = map[string]string{"Authorization": "Bearer Oracle"}
+
+type ociInstance struct {
+	Id                  string                       `json:"id"`
+	CompartmentId       string                       `json:"compartmentId"`
+	CanonicalRegionName string                       `json:"canonicalRegionName"`
+	AvailabilityDomain  string                       `json:"availabilityDomain"`
+	Shape               string                       `json:"shape"`
+	Image               string                       `json:"image"`
+	FreeformTags        map[string]string            `json:"freeformTags"`
+	DefinedTags         map[string]map[string]string `json:"definedTags"`
+}
+
+type ociProvider struct{}
+
+func (p *ociProvider) Name() string {
+	return "oci"
+}
+
+func (p *ociProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), OCI_METADATA_URL) + "/opc/v2/" + item
+}
+
+func (p *ociProvider) Detect(ctx context.Context) bool {
+	status, _, err := metadataProbe(ctx, metadataClient(2*time.Second), p.url("instance/id"), ociHeaders)
+	return err == nil && status == 200
+}
+
+func (p *ociProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	body, err := metadataGet(ctx, metadataClient(2*time.Second), p.url("instance/"), ociHeaders)
+	if err != nil {
+		return nil, err
+	}
+	var instance ociInstance
+	if err = json.Unmarshal([]byte(body), &instance); err != nil {
+		return nil, err
+	}
+	if len(instance.Id) == 0 {
+		return nil, errors.New("OCI metadata has no instance id")
+	}
+	// the tenancy is not exposed, the compartment is the closest account scope
+	result := &InstanceID{
+		Id:           instance.Id,
+		Cloud:        "OCI",
+		Account:      instance.CompartmentId,
+		Region:       instance.CanonicalRegionName,
+		Zone:         instance.AvailabilityDomain,
+		InstanceType: instance.Shape,
+		ImageId:      instance.Image,
+		Lifecycle:    LIFECYCLE_ON_DEMAND,
+	}
+	tags := make(map[string]string)
+	for key, value := range instance.FreeformTags {
+		tags[key] = value
+	}
+	// defined tags live in namespaces
+	for namespace, values := range instance.DefinedTags {
+		for key, value := range values {
+			tags[namespace+"."+key] = value
+		}
+	}
+	if len(tags) > 0 {
+		result.Tags = tags
+	}
+	return result, nil
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const ociTestInstance = `{
+ "id": "ocid1.instance.oc1.eu-frankfurt-1.abcd",
+ "compartmentId": "ocid1.compartment.oc1..efgh",
+ "canonicalRegionName": "eu-frankfurt-1",
+ "availabilityDomain": "Uocm:EU-FRANKFURT-1-AD-1",
+ "shape": "VM.Standard.E4.Flex",
+ "image": "ocid1.image.oc1.eu-frankfurt-1.ijkl",
+ "freeformTags": {"env": "prod"},
+ "definedTags": {"Operations": {"CostCenter": "42"}}
+}`
+
+// ociHandler serves IMDSv2 and, like the real service, refuses requests
+// without the Bearer Oracle header
+func ociHandler(instance string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/opc/v2/instance/id", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ocid1.instance.oc1.eu-frankfurt-1.abcd"))
+	})
+	mux.HandleFunc("/opc/v2/instance/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(instance))
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer Oracle" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func TestOciDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    bool
+	}{
+		{"metadata service", ociHandler(ociTestInstance), true},
+		// IMDSv1 is served under /opc/v1 and does not need the header
+		{"IMDSv1 only", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/opc/v1/") {
+				http.NotFound(w, r)
+			}
+		}), false},
+		{"not found", http.NotFoundHandler(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetadataServer(t, "oci", tt.handler)
+			if got := (&ociProvider{}).Detect(context.Background()); got != tt.want {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOciFetch(t *testing.T) {
+	useMetadataServer(t, "oci", ociHandler(ociTestInstance))
+	id, err := (&ociProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:           "ocid1.instance.oc1.eu-frankfurt-1.abcd",
+		Cloud:        "OCI",
+		Account:      "ocid1.compartment.oc1..efgh",
+		Region:       "eu-frankfurt-1",
+		Zone:         "Uocm:EU-FRANKFURT-1-AD-1",
+		InstanceType: "VM.Standard.E4.Flex",
+		ImageId:      "ocid1.image.oc1.eu-frankfurt-1.ijkl",
+		Lifecycle:    LIFECYCLE_ON_DEMAND,
+		Tags:         map[string]string{"env": "prod", "Operations.CostCenter": "42"},
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+}
+
+func TestOciFetchWithoutId(t *testing.T) {
+	useMetadataServer(t, "oci", ociHandler(`{"shape": "VM.Standard.E4.Flex"}`))
+	if _, err := (&ociProvider{}).Fetch(context.Background()); err == nil {
+		t.Error("Fetch() without id succeeded")
+	}
+}
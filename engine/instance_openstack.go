@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+const OPENSTACK_METADATA_URL = "http://169.254.169.254"
+
+// where config drives (label config-2) are usually mounted
+var openStackConfigDrives = []string{"/mnt/config", "/media/configdrive", "/config-drive", "/mnt/config-2"}
+
+type openStackMetadata struct {
+	Uuid             string            `json:"uuid"`
+	Name             string            `json:"name"`
+	AvailabilityZone string            `json:"availability_zone"`
+	ProjectId        string            `json:"project_id"`
+	Meta             map[string]string `json:"meta"`
+}
+
+type openStackProvider struct{}
+
+func (p *openStackProvider) Name() string {
+	return "openstack"
+}
+
+func (p *openStackProvider) url(item string) string {
+	return metadataBaseUrl(p.Name(), OPENSTACK_METADATA_URL) + "/" + item
+}
+
+// configDrive returns meta_data.json from a mounted config drive
+func (p *openStackProvider) configDrive() []byte {
+	for _, dir := range openStackConfigDrives {
+		data, err := ioutil.ReadFile(path.Join(dir, "openstack", "latest", "meta_data.json"))
+		if err == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+func (p *openStackProvider) Detect(ctx context.Context) bool {
+	if p.configDrive() != nil {
+		return true
+	}
+	status, _, err := metadataProbe(ctx, metadataClient(2*time.Second), p.url("openstack/latest/meta_data.json"), nil)
+	return err == nil && status == 200
+}
+
+// the config drive does not tell the public address, only the EC2
+// compatible tree of the metadata service does
+func (p *openStackProvider) PublicAddr(ctx context.Context) (string, error) {
+	return optionalMetadata(metadataGet(ctx, metadataClient(2*time.Second), p.url("latest/meta-data/public-ipv4"), nil))
+}
+
+func (p *openStackProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	client := metadataClient(2 * time.Second)
+	data := p.configDrive()
+	online := data == nil
+	if online {
+		body, err := metadataGet(ctx, client, p.url("openstack/latest/meta_data.json"), nil)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(body)
+	}
+	var metadata openStackMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	if len(metadata.Uuid) == 0 {
+		return nil, errors.New("OpenStack metadata has no uuid")
+	}
+	result := &InstanceID{
+		Id:        metadata.Uuid,
+		Cloud:     "OpenStack",
+		Account:   metadata.ProjectId,
+		Zone:      metadata.AvailabilityZone,
+		Lifecycle: LIFECYCLE_ON_DEMAND,
+	}
+	if len(metadata.Meta) > 0 {
+		result.Tags = metadata.Meta
+	}
+	// the flavor and image are only served by the EC2 compatible tree
+	if online {
+		if flavor, err := metadataGet(ctx, client, p.url("latest/meta-data/instance-type"), nil); err == nil {
+			result.InstanceType = flavor
+		}
+		if image, err := metadataGet(ctx, client, p.url("latest/meta-data/ami-id"), nil); err == nil {
+			result.ImageId = image
+		}
+		if cloudConfig.ReportPublicIp {
+			result.PublicAddr, _ = metadataGet(ctx, client, p.url("latest/meta-data/public-ipv4"), nil)
+		}
+	}
+	return result, nil
+}
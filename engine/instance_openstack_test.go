@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const openStackTestMetadata = `{
+ "uuid": "d8e02d56-2648-49a3-bf97-6be8f1204f38",
+ "name": "web-1",
+ "availability_zone": "nova",
+ "project_id": "2a5b4c7e8f9d4e6a8b1c3d5e7f9a1b2c",
+ "meta": {"env": "prod"}
+}`
+
+// useConfigDrives looks for config drives in dirs until the test ends
+func useConfigDrives(t *testing.T, dirs ...string) {
+	previous := openStackConfigDrives
+	openStackConfigDrives = dirs
+	t.Cleanup(func() { openStackConfigDrives = previous })
+}
+
+func openStackHandler() http.Handler {
+	items := map[string]string{
+		"/openstack/latest/meta_data.json": openStackTestMetadata,
+		"/latest/meta-data/instance-type":  "m1.small",
+		"/latest/meta-data/ami-id":         "ami-00000001",
+		"/latest/meta-data/public-ipv4":    "203.0.113.7",
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := items[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	})
+}
+
+func TestOpenStackFetch(t *testing.T) {
+	useMetadataServer(t, "openstack", openStackHandler())
+	useConfigDrives(t, filepath.Join(t.TempDir(), "missing"))
+	cloudConfig.ReportPublicIp = true
+
+	if !(&openStackProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = false, want true")
+	}
+	id, err := (&openStackProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:           "d8e02d56-2648-49a3-bf97-6be8f1204f38",
+		Cloud:        "OpenStack",
+		Account:      "2a5b4c7e8f9d4e6a8b1c3d5e7f9a1b2c",
+		Zone:         "nova",
+		InstanceType: "m1.small",
+		ImageId:      "ami-00000001",
+		Lifecycle:    LIFECYCLE_ON_DEMAND,
+		PublicAddr:   "203.0.113.7",
+		Tags:         map[string]string{"env": "prod"},
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+}
+
+// a mounted config drive is read without asking the metadata service
+func TestOpenStackConfigDrive(t *testing.T) {
+	useMetadataServer(t, "openstack", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected metadata request %s", r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	drive := t.TempDir()
+	writeTestFiles(t, drive, map[string]string{"openstack/latest/meta_data.json": openStackTestMetadata})
+	useConfigDrives(t, filepath.Join(t.TempDir(), "missing"), drive)
+	cloudConfig.ReportPublicIp = true
+
+	if !(&openStackProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = false, want true")
+	}
+	id, err := (&openStackProvider{}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceID{
+		Id:        "d8e02d56-2648-49a3-bf97-6be8f1204f38",
+		Cloud:     "OpenStack",
+		Account:   "2a5b4c7e8f9d4e6a8b1c3d5e7f9a1b2c",
+		Zone:      "nova",
+		Lifecycle: LIFECYCLE_ON_DEMAND,
+		Tags:      map[string]string{"env": "prod"},
+	}
+	if !reflect.DeepEqual(*id, want) {
+		t.Errorf("Fetch() = %+v, want %+v", *id, want)
+	}
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const VULTR_METADATA_URL = "http://169.254.169.254"
+
+type vultrMetadata struct {
+	// the v2 id is the one used by the current API
+	InstanceV2Id string `json:"instance-v2-id"`
+	InstanceId   string `json:"instanceid"`
+	Region       struct {
+		RegionCode string `json:"regioncode"`
+	} `json:"region"`
+	Tags       []string `json:"tags"`
+	Interfaces []struct {
+		NetworkType string `json:"network-type"`
+		Ipv4        struct {
+			Address string `json:"address"`
+		} `json:"ipv4"`
+	} `json:"interfaces"`
+}
+
+type vultrProvider struct{}
+
+func (p *vultrProvider) Name() string {
+	return "vultr"
+}
+
+func (p *vultrProvider) url() string {
+	return metadataBaseUrl(p.Name(), VULTR_METADATA_URL) + "/v1.json"
+}
+
+func (p *vultrProvider) fetchMetadata(ctx context.Context) (*vultrMetadata, error) {
+	body, err := metadataGet(ctx, metadataClient(2*time.Second), p.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata vultrMetadata
+	if err = json.Unmarshal([]byte(body), &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func (p *vultrProvider) Detect(ctx context.Context) bool {
+	metadata, err := p.fetchMetadata(ctx)
+	return err == nil && (len(metadata.InstanceV2Id) > 0 || len(metadata.InstanceId) > 0)
+}
+
+func (p *vultrProvider) Fetch(ctx context.Context) (*InstanceID, error) {
+	metadata, err := p.fetchMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := metadata.InstanceV2Id
+	if len(id) == 0 {
+		id = metadata.InstanceId
+	}
+	if len(id) == 0 {
+		return nil, errors.New("Vultr metadata has no instance id")
+	}
+	// the plan is not exposed by the metadata service
+	result := &InstanceID{
+		Id:        id,
+		Cloud:     "Vultr",
+		Region:    metadata.Region.RegionCode,
+		Lifecycle: LIFECYCLE_ON_DEMAND,
+	}
+	if len(metadata.Tags) > 0 {
+		result.Tags = make(map[string]string)
+		for _, tag := range metadata.Tags {
+			result.Tags[tag] = ""
+		}
+	}
+	if cloudConfig.ReportPublicIp {
+		result.PublicAddr = metadata.publicAddr()
+	}
+	return result, nil
+}
+
+// v1.json is the only document that tells which interface is public
+func (p *vultrProvider) PublicAddr(ctx context.Context) (string, error) {
+	metadata, err := p.fetchMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	return metadata.publicAddr(), nil
+}
+
+func (metadata *vultrMetadata) publicAddr() string {
+	for _, iface := range metadata.Interfaces {
+		if iface.NetworkType == "public" {
+			return iface.Ipv4.Address
+		}
+	}
+	return ""
+}
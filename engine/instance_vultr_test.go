@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func vultrHandler(metadata string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(metadata))
+	})
+	return mux
+}
+
+func TestVultrFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		want     string
+	}{
+		{"v2 id", `{"instance-v2-id": "9f3c1a2b-1234-4cde-8f00-0123456789ab", "instanceid": "51234567",
+			"region": {"regioncode": "AMS"}, "tags": ["prod"],
+			"interfaces": [{"network-type": "private", "ipv4": {"address": "10.1.96.3"}},
+				{"network-type": "public", "ipv4": {"address": "95.179.1.2"}}]}`,
+			"9f3c1a2b-1234-4cde-8f00-0123456789ab"},
+		// instances created before the v2 API only have the numeric id
+		{"v1 id", `{"instanceid": "51234567", "region": {"regioncode": "AMS"}, "tags": ["prod"],
+			"interfaces": [{"network-type": "public", "ipv4": {"address": "95.179.1.2"}}]}`,
+			"51234567"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetadataServer(t, "vultr", vultrHandler(tt.metadata))
+			cloudConfig.ReportPublicIp = true
+			if !(&vultrProvider{}).Detect(context.Background()) {
+				t.Error("Detect() = false, want true")
+			}
+			id, err := (&vultrProvider{}).Fetch(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := InstanceID{
+				Id:         tt.want,
+				Cloud:      "Vultr",
+				Region:     "AMS",
+				Lifecycle:  LIFECYCLE_ON_DEMAND,
+				PublicAddr: "95.179.1.2",
+				Tags:       map[string]string{"prod": ""},
+			}
+			if !reflect.DeepEqual(*id, want) {
+				t.Errorf("Fetch() = %+v, want %+v", *id, want)
+			}
+		})
+	}
+}
+
+func TestVultrFetchWithoutId(t *testing.T) {
+	useMetadataServer(t, "vultr", vultrHandler(`{"region": {"regioncode": "AMS"}}`))
+	if (&vultrProvider{}).Detect(context.Background()) {
+		t.Error("Detect() = true, want false")
+	}
+	if _, err := (&vultrProvider{}).Fetch(context.Background()); err == nil {
+		t.Error("Fetch() without id succeeded")
+	}
+}
@@ -1,94 +1,368 @@
 package engine
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+// overall deadline for probing all metadata services
+const DEFAULT_PROBE_TIMEOUT = 3 * time.Second
+
+const (
+	LIFECYCLE_ON_DEMAND = "on-demand"
+	// spot, preemptible and low priority instances
+	LIFECYCLE_SPOT = "spot"
+)
+
+// InstanceID identifies the machine and carries what is needed to price it.
+// The fields are documented in README.md, changes to them bump
+// PAYLOAD_SCHEMA_VERSION, and IDENTITY_SCHEMA_VERSION when the cached
+// identity lacks them.
 type InstanceID struct {
 	Id string `json:"id"`
 	Cloud string `json:"cloud"`
 	Addr string `json:"addr"`
+	// AWS account, GCP project, Azure subscription
+	Account string `json:"account,omitempty"`
+	// Azure resource group
+	ResourceGroup string `json:"resource_group,omitempty"`
+	Region string `json:"region,omitempty"`
+	Zone string `json:"zone,omitempty"`
+	InstanceType string `json:"instance_type,omitempty"`
+	ImageId string `json:"image_id,omitempty"`
+	Lifecycle string `json:"lifecycle,omitempty"`
+	// reported by the metadata service when cloud.report_public_ip is set
+	PublicAddr string `json:"public_addr,omitempty"`
+	Addresses []NetAddress `json:"addresses,omitempty"`
+	// instance tags, labels or attributes passing cloud.tags allow/deny
+	Tags map[string]string `json:"tags,omitempty"`
+	// the id is the host fingerprint because no metadata service answered
+	fallback bool
+}
+
+// CloudProvider identifies instances of one cloud through its metadata service
+type CloudProvider interface {
+	// Name is the key used in the cloud config, e.g. "aws"
+	Name() string
+	// Detect cheaply checks whether the metadata service of this cloud answers
+	Detect(ctx context.Context) bool
+	// Fetch reads the instance identity
+	Fetch(ctx context.Context) (*InstanceID, error)
 }
 
-type revealFunction func () (*InstanceID, error)
+// InterruptionNotice announces that a spot or preemptible instance is
+// about to be stopped by the cloud
+type InterruptionNotice struct {
+	Cloud string `json:"cloud"`
+	// terminate, stop, hibernate or preempt
+	Action string `json:"action"`
+	// when the action happens, empty when the cloud does not tell
+	Time string `json:"time,omitempty"`
+}
 
-func dummy() (*InstanceID, error) {
-	return &InstanceID{Id : "", Cloud : ""}, nil
+// InterruptionWatcher is implemented by providers of clouds that announce
+// spot or preemptible interruptions through the metadata service
+type InterruptionWatcher interface {
+	// Interruption returns nil while no interruption is scheduled
+	Interruption(ctx context.Context) (*InterruptionNotice, error)
 }
 
-// Get preferred outbound ip of this machine
-func getOutboundIP() string {
-    conn, err := net.Dial("udp", "8.8.8.8:80")
-    if err != nil {
-        log.Fatal(err)
-    }
-    defer conn.Close()
+// PublicAddressReader is implemented by providers that can read the public
+// address on its own, without the requests of a full Fetch
+type PublicAddressReader interface {
+	// PublicAddr returns "" when the instance has no public address
+	PublicAddr(ctx context.Context) (string, error)
+}
+
+// registered providers in their default probing order
+var cloudProviders = []CloudProvider{
+	&digitalOceanProvider{},
+	&awsProvider{},
+	&gcpProvider{},
+	&azureProvider{},
+	&ociProvider{},
+	&hetznerProvider{},
+	&linodeProvider{},
+	&vultrProvider{},
+	// after aws, its EC2 compatible tree makes it answer the aws probe as well
+	&openStackProvider{},
+}
 
-    localAddr := conn.LocalAddr().(*net.UDPAddr)
+var cloudConfig = CloudConfig{Timeout: DEFAULT_PROBE_TIMEOUT}
 
-    return localAddr.IP.String()
+// RegisterProvider adds a provider after the already registered ones
+func RegisterProvider(p CloudProvider) {
+	cloudProviders = append(cloudProviders, p)
 }
 
-func digitalOcean() (*InstanceID, error) {
-	var resp *http.Response
-	var err error
-	client := http.Client{
-		Timeout: 2 * time.Second,
+// ProviderNames returns the names of all registered providers
+func ProviderNames() []string {
+	var names []string
+	for _, p := range cloudProviders {
+		names = append(names, p.Name())
 	}
-	resp, err = client.Get("http://169.254.169.254/metadata/v1/id")
+	return names
+}
 
-	if err != nil || resp.StatusCode != 200 {
-		return nil, err
+func findProvider(name string) CloudProvider {
+	for _, p := range cloudProviders {
+		if p.Name() == name {
+			return p
+		}
 	}
+	return nil
+}
 
-	defer resp.Body.Close()
-	var body []byte
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// providerForCloud returns the provider whose identities carry the given
+// cloud label, e.g. the aws provider for "AWS"
+func providerForCloud(cloud string) CloudProvider {
+	for name, label := range cloudLabels {
+		if label == cloud {
+			return findProvider(name)
+		}
 	}
-	return &InstanceID{Id : string(body), Cloud : "DigitalOcean"}, nil
+	return nil
 }
 
-func aws() (*InstanceID, error) {
-	var resp *http.Response
-	var err error
-	client := http.Client{
-		Timeout: 2 * time.Second,
+// SetCloudConfig sets the options used by instance identification
+func SetCloudConfig(c CloudConfig) error {
+	var names []string
+	names = append(names, c.Providers...)
+	names = append(names, c.DisabledProviders...)
+	for name := range c.MetadataUrls {
+		names = append(names, name)
 	}
-	resp, err = client.Get("http://169.254.169.254/latest/meta-data/instance-id")
+	for _, name := range names {
+		if findProvider(name) == nil {
+			return fmt.Errorf("unknown cloud provider %q, expected one of %s", name, strings.Join(ProviderNames(), ", "))
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_PROBE_TIMEOUT
+	}
+	cloudConfig = c
+	return nil
+}
+
+// enabledProviders returns the providers to probe in priority order
+func enabledProviders() []CloudProvider {
+	disabled := make(map[string]bool)
+	for _, name := range cloudConfig.DisabledProviders {
+		disabled[name] = true
+	}
+	var ordered []CloudProvider
+	if len(cloudConfig.Providers) == 0 {
+		ordered = cloudProviders
+	} else {
+		for _, name := range cloudConfig.Providers {
+			if p := findProvider(name); p != nil {
+				ordered = append(ordered, p)
+			}
+		}
+	}
+	var result []CloudProvider
+	for _, p := range ordered {
+		if !disabled[p.Name()] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
 
-	if err != nil || resp.StatusCode != 200{
-		return nil, err
+// metadataBaseUrl returns the configured metadata url of a provider
+func metadataBaseUrl(name string, defaultUrl string) string {
+	if url, ok := cloudConfig.MetadataUrls[name]; ok && len(url) > 0 {
+		return strings.TrimRight(url, "/")
 	}
+	return defaultUrl
+}
+
+// metadataTransport is shared by all metadata clients so the connections
+// to the metadata service are reused instead of leaking a pool per call.
+// It never goes through a proxy, metadata services are link-local.
+var metadataTransport = &http.Transport{
+	Proxy:           nil,
+	MaxIdleConns:    4,
+	IdleConnTimeout: 30 * time.Second,
+}
+
+// metadataClient returns a client using the shared metadata transport
+func metadataClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: metadataTransport,
+	}
+}
+
+// metadataStatusError is returned when a metadata endpoint answers with anything but 200
+type metadataStatusError struct {
+	Url        string
+	StatusCode int
+}
+
+func (e *metadataStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.Url, e.StatusCode)
+}
 
+// metadataGet reads a metadata endpoint
+func metadataGet(ctx context.Context, client *http.Client, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
-	var body []byte
-	body, err = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", &metadataStatusError{Url: url, StatusCode: resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return &InstanceID{Id : string(body), Cloud : "AWS"}, nil
+	return strings.TrimSpace(string(body)), nil
 }
 
-func GetInstanceID() *InstanceID {
-	functors := []revealFunction {
-		digitalOcean,
-		aws,
-		dummy,
+// optionalMetadata turns the 404 of an item the instance does not have into
+// an empty value
+func optionalMetadata(value string, err error) (string, error) {
+	var statusErr *metadataStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return "", nil
 	}
+	return value, err
+}
+
+// metadataProbe returns the status and headers of a metadata endpoint
+func metadataProbe(ctx context.Context, client *http.Client, url string, headers map[string]string) (int, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, resp.Header, nil
+}
 
-	for _, functor := range functors {
-		result, err := functor()
-		if err == nil && result != nil {
-			result.Addr = getOutboundIP()
-			return result
+// returns the part after the last slash of a resource path
+func lastPathElement(value string) string {
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		return value[i+1:]
+	}
+	return value
+}
+
+type probeResult struct {
+	index int
+	id    *InstanceID
+}
+
+// probeProviders runs all providers concurrently and returns the result of
+// the first one in priority order that identified the instance. Lower
+// priority probes are cancelled as soon as the winner is known, and have
+// returned by the time probeProviders does.
+func probeProviders(ctx context.Context, providers []CloudProvider) *InstanceID {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan probeResult, len(providers))
+	for i, p := range providers {
+		wg.Add(1)
+		go func(i int, p CloudProvider) {
+			defer wg.Done()
+			var id *InstanceID
+			if p.Detect(ctx) {
+				var err error
+				id, err = p.Fetch(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Failed to read %s metadata: %v", p.Name(), err)
+					}
+					id = nil
+				}
+			}
+			results <- probeResult{index: i, id: id}
+		}(i, p)
+	}
+
+	done := make([]bool, len(providers))
+	found := make([]*InstanceID, len(providers))
+	for range providers {
+		r := <-results
+		done[r.index] = true
+		found[r.index] = r.id
+		for i := range providers {
+			if !done[i] {
+				break
+			}
+			if found[i] != nil {
+				return found[i]
+			}
 		}
 	}
 	return nil
 }
 
+// GetInstanceID probes the enabled providers under one deadline and falls
+// back to the OnPrem identity. When DMI names the cloud only its provider is
+// asked, and the cloud is still reported if its metadata is unreachable.
+func GetInstanceID() *InstanceID {
+	ctx, cancel := context.WithTimeout(context.Background(), cloudConfig.Timeout)
+	defer cancel()
+
+	providers := enabledProviders()
+	var result *InstanceID
+	dmi := readDMI()
+	hint := ""
+	if !cloudConfig.SkipDmi {
+		hint = dmi.cloud()
+	}
+	var hinted []CloudProvider
+	for _, p := range providers {
+		if p.Name() == hint {
+			hinted = append(hinted, p)
+		}
+	}
+	if len(hinted) > 0 {
+		result = probeProviders(ctx, hinted)
+		if result == nil {
+			log.Printf("DMI reports %s, but its metadata service is not available", hint)
+			result = dmiInstanceID(dmi, hint)
+		}
+	} else {
+		// the hinted provider is disabled, or has no metadata support
+		result = probeProviders(ctx, providers)
+		if result == nil && len(hint) > 0 && findProvider(hint) == nil {
+			result = dmiInstanceID(dmi, hint)
+		}
+	}
+	if result == nil {
+		result, _ = onPrem()
+	}
+	// filtered before the identity is cached, see storedTags
+	result.Tags = storedTags(result.Tags)
+	result.Addr = getOutboundIP()
+	return result
+}
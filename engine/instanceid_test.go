@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// useMetadataServer serves the metadata of provider from handler and probes
+// only that provider until the test ends
+func useMetadataServer(t *testing.T, provider string, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	previous := cloudConfig
+	err := SetCloudConfig(CloudConfig{
+		Providers:    []string{provider},
+		MetadataUrls: map[string]string{provider: server.URL},
+		SkipDmi:      true,
+		Timeout:      2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		cloudConfig = previous
+	})
+	return server
+}
+
+func TestGetInstanceIDDeadline(t *testing.T) {
+	// answers nothing until the client gives up
+	useMetadataServer(t, "gcp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	cloudConfig.Timeout = 300 * time.Millisecond
+
+	start := time.Now()
+	id := GetInstanceID()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("GetInstanceID took %v with a %v deadline", elapsed, cloudConfig.Timeout)
+	}
+	if id == nil || id.Cloud != CLOUD_ON_PREM {
+		t.Errorf("GetInstanceID() = %+v, want the OnPrem fallback", id)
+	}
+}
+
+func TestGetInstanceIDProviderOrder(t *testing.T) {
+	gcp := httptest.NewServer(gcpHandler(gcpTestMetadata))
+	defer gcp.Close()
+	azure := httptest.NewServer(azureHandler(t, azureTestInstance))
+	defer azure.Close()
+	previous := cloudConfig
+	defer func() { cloudConfig = previous }()
+	err := SetCloudConfig(CloudConfig{
+		Providers:    []string{"azure", "gcp"},
+		MetadataUrls: map[string]string{"gcp": gcp.URL, "azure": azure.URL},
+		SkipDmi:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := GetInstanceID()
+	if id == nil || id.Cloud != "Azure" {
+		t.Fatalf("GetInstanceID() = %+v, want the first provider in order", id)
+	}
+
+	cloudConfig.DisabledProviders = []string{"azure"}
+	id = GetInstanceID()
+	if id == nil || id.Cloud != "GCP" {
+		t.Fatalf("GetInstanceID() = %+v with azure disabled, want GCP", id)
+	}
+}
+
+func TestMetadataClientSharesTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	metadataGet(context.Background(), metadataClient(time.Second), server.URL, nil)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		if _, err := metadataGet(context.Background(), metadataClient(time.Second), server.URL, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("%d goroutines after 50 calls, %d before", after, before)
+	}
+}
+
+// the public address is read on every collection, without the other items
+func TestFetchPublicAddr(t *testing.T) {
+	var requests []string
+	items := map[string]string{"instance/network-interfaces/0/access-configs/0/external-ip": "34.1.2.3"}
+	useMetadataServer(t, "gcp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		gcpHandler(items).ServeHTTP(w, r)
+	}))
+
+	if addr := fetchPublicAddr(&InstanceID{Id: "4520031799277581759", Cloud: "GCP"}); addr != "34.1.2.3" {
+		t.Errorf("fetchPublicAddr() = %q, want 34.1.2.3", addr)
+	}
+	want := []string{"/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
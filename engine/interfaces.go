@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+const NETWORK_SAMPLE_KEY = "networkSample"
+
+// InterfaceStats holds the counters of one network interface since it came up
+type InterfaceStats struct {
+	Name        string `json:"name"`
+	BytesSent   uint64 `json:"bytes_sent"`
+	BytesRecv   uint64 `json:"bytes_recv"`
+	PacketsSent uint64 `json:"packets_sent"`
+	PacketsRecv uint64 `json:"packets_recv"`
+	ErrorsIn    uint64 `json:"errors_in"`
+	ErrorsOut   uint64 `json:"errors_out"`
+	DropsIn     uint64 `json:"drops_in"`
+	DropsOut    uint64 `json:"drops_out"`
+	// bytes per second since the previous collection, omitted on the first
+	// collection and after the counters were reset
+	SentRate *float64 `json:"bytes_sent_per_sec,omitempty"`
+	RecvRate *float64 `json:"bytes_recv_per_sec,omitempty"`
+}
+
+// glob patterns for virtualInterfacePrefixes
+var DEFAULT_INTERFACE_DENY = func() []string {
+	var result []string
+	for _, prefix := range virtualInterfacePrefixes {
+		result = append(result, prefix+"*")
+	}
+	return result
+}()
+
+var interfaceFilter = TagFilter{Deny: DEFAULT_INTERFACE_DENY}
+
+// SetInterfaceFilter selects the interfaces reported in stat.interfaces
+func SetInterfaceFilter(filter TagFilter) {
+	interfaceFilter = filter
+}
+
+// setInterfaceStats reports the allowed interfaces with rates computed from
+// the sample stored by the previous collection
+func setInterfaceStats(ctx *FetcherContext, result *MachineStats, counters []net.IOCountersStat) {
+	previous := loadCounterSample(ctx, NETWORK_SAMPLE_KEY)
+	sample := newCounterSample()
+	for _, c := range counters {
+		if !interfaceFilter.allows(c.Name) {
+			continue
+		}
+		sample.set(c.Name, "bytes_sent", c.BytesSent)
+		sample.set(c.Name, "bytes_recv", c.BytesRecv)
+		stats := InterfaceStats{
+			Name:        c.Name,
+			BytesSent:   c.BytesSent,
+			BytesRecv:   c.BytesRecv,
+			PacketsSent: c.PacketsSent,
+			PacketsRecv: c.PacketsRecv,
+			ErrorsIn:    c.Errin,
+			ErrorsOut:   c.Errout,
+			DropsIn:     c.Dropin,
+			DropsOut:    c.Dropout,
+		}
+		if rate, ok := sample.rate(previous, c.Name, "bytes_sent"); ok {
+			stats.SentRate = &rate
+		}
+		if rate, ok := sample.rate(previous, c.Name, "bytes_recv"); ok {
+			stats.RecvRate = &rate
+		}
+		result.Interfaces = append(result.Interfaces, stats)
+	}
+	storeCounterSample(ctx, NETWORK_SAMPLE_KEY, sample)
+}
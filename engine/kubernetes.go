@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const KUBERNETES_API_TIMEOUT = 5 * time.Second
+
+// mounted into every pod unless automountServiceAccountToken is off
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// downward API variables expected in the DaemonSet spec
+const (
+	ENV_NODE_NAME     = "NODE_NAME"
+	ENV_POD_NAME      = "POD_NAME"
+	ENV_POD_NAMESPACE = "POD_NAMESPACE"
+)
+
+// node labels naming the node pool, by distribution
+var nodePoolLabels = []string{
+	"cloud.google.com/gke-nodepool",
+	"eks.amazonaws.com/nodegroup",
+	"alpha.eksctl.io/nodegroup-name",
+	"kubernetes.azure.com/agentpool",
+	"agentpool",
+	"doks.digitalocean.com/node-pool",
+	"karpenter.sh/nodepool",
+	"karpenter.sh/provisioner-name",
+	"kops.k8s.io/instancegroup",
+}
+
+// node labels and cloud tags naming the cluster
+var (
+	clusterNameLabels = []string{"alpha.eksctl.io/cluster-name", "kubernetes.azure.com/cluster"}
+	clusterNameTags   = []string{"cluster-name", "aws:eks:cluster-name", "eks:cluster-name"}
+)
+
+const CLUSTER_OWNERSHIP_TAG_PREFIX = "kubernetes.io/cluster/"
+
+// KubernetesInfo describes the cluster the agent pod runs in
+type KubernetesInfo struct {
+	ClusterName string `json:"cluster_name,omitempty"`
+	NodeName    string `json:"node_name,omitempty"`
+	NodePool    string `json:"node_pool,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	PodName     string `json:"pod_name,omitempty"`
+	// resource quantities as reported by the API, e.g. "cpu": "4", "memory": "16374584Ki"
+	Capacity    map[string]string `json:"capacity,omitempty"`
+	Allocatable map[string]string `json:"allocatable,omitempty"`
+}
+
+type kubernetesNode struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		Capacity    map[string]string `json:"capacity"`
+		Allocatable map[string]string `json:"allocatable"`
+	} `json:"status"`
+}
+
+type kubernetesPod struct {
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+var kubernetesConfig KubernetesConfig
+
+// warn about API errors once, they usually mean missing RBAC rules
+var kubernetesWarned bool
+
+// SetKubernetesConfig sets the options used by cluster detection
+func SetKubernetesConfig(c KubernetesConfig) {
+	kubernetesConfig = c
+}
+
+// inKubernetes reports whether the agent runs in a pod
+func inKubernetes() bool {
+	if len(os.Getenv("KUBERNETES_SERVICE_HOST")) > 0 {
+		return true
+	}
+	_, err := os.Stat(path.Join(serviceAccountDir, "token"))
+	return err == nil
+}
+
+func kubernetesApiUrl() string {
+	if len(kubernetesConfig.ApiUrl) > 0 {
+		return strings.TrimRight(kubernetesConfig.ApiUrl, "/")
+	}
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 {
+		return ""
+	}
+	if len(port) == 0 {
+		port = "443"
+	}
+	return "https://" + net.JoinHostPort(host, port)
+}
+
+// kubernetesClient is built for every collection so a rotated CA is picked
+// up; without keep-alives no idle connection outlives it
+func kubernetesClient() *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}
+	if data, err := ioutil.ReadFile(path.Join(serviceAccountDir, "ca.crt")); err == nil {
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(data) {
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+	}
+	return &http.Client{Timeout: KUBERNETES_API_TIMEOUT, Transport: transport}
+}
+
+// kubernetesGet reads an API resource with the service account token
+func kubernetesGet(ctx context.Context, client *http.Client, resource string, result interface{}) error {
+	headers := map[string]string{"Accept": "application/json"}
+	if token := readTrimmed(path.Join(serviceAccountDir, "token")); len(token) > 0 {
+		headers["Authorization"] = "Bearer " + token
+	}
+	body, err := metadataGet(ctx, client, kubernetesApiUrl()+resource, headers)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), result)
+}
+
+func firstLabel(labels map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value := labels[key]; len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// clusterNameFromTags finds the cluster name in cloud tags, e.g. the GKE
+// cluster-name attribute or the kubernetes.io/cluster/<name> ownership tag
+func clusterNameFromTags(tags map[string]string) string {
+	if name := firstLabel(tags, clusterNameTags); len(name) > 0 {
+		return name
+	}
+	for key := range tags {
+		if strings.HasPrefix(key, CLUSTER_OWNERSHIP_TAG_PREFIX) {
+			return key[len(CLUSTER_OWNERSHIP_TAG_PREFIX):]
+		}
+	}
+	return ""
+}
+
+// getKubernetesInfo describes the cluster, or returns nil outside of
+// Kubernetes. Node details require get permission on nodes.
+func getKubernetesInfo(tags map[string]string) *KubernetesInfo {
+	if kubernetesConfig.Disabled || !inKubernetes() {
+		return nil
+	}
+	result := &KubernetesInfo{
+		NodeName:  os.Getenv(ENV_NODE_NAME),
+		Namespace: os.Getenv(ENV_POD_NAMESPACE),
+		PodName:   os.Getenv(ENV_POD_NAME),
+	}
+	if len(result.Namespace) == 0 {
+		result.Namespace = readTrimmed(path.Join(serviceAccountDir, "namespace"))
+	}
+	if len(result.PodName) == 0 {
+		// the pod name is the hostname unless the pod uses the host network
+		result.PodName, _ = os.Hostname()
+	}
+
+	var labels map[string]string
+	if len(kubernetesApiUrl()) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), KUBERNETES_API_TIMEOUT)
+		defer cancel()
+		client := kubernetesClient()
+		var err error
+		if len(result.NodeName) == 0 && len(result.Namespace) > 0 && len(result.PodName) > 0 {
+			var pod kubernetesPod
+			resource := "/api/v1/namespaces/" + url.PathEscape(result.Namespace) + "/pods/" + url.PathEscape(result.PodName)
+			if err = kubernetesGet(ctx, client, resource, &pod); err == nil {
+				result.NodeName = pod.Spec.NodeName
+			}
+		}
+		if err == nil && len(result.NodeName) > 0 {
+			var node kubernetesNode
+			if err = kubernetesGet(ctx, client, "/api/v1/nodes/"+url.PathEscape(result.NodeName), &node); err == nil {
+				labels = node.Metadata.Labels
+				result.Capacity = node.Status.Capacity
+				result.Allocatable = node.Status.Allocatable
+			}
+		}
+		if err != nil && !kubernetesWarned {
+			log.Printf("Failed to read node from Kubernetes API: %v", err)
+			kubernetesWarned = true
+		}
+	}
+
+	result.NodePool = firstLabel(labels, nodePoolLabels)
+	result.ClusterName = kubernetesConfig.ClusterName
+	if len(result.ClusterName) == 0 {
+		result.ClusterName = firstLabel(labels, clusterNameLabels)
+	}
+	if len(result.ClusterName) == 0 {
+		result.ClusterName = clusterNameFromTags(tags)
+	}
+	return result
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const kubernetesTestToken = "eyJhbGciOiJSUzI1NiJ9.test"
+
+// useKubernetesApi runs the agent as pod agent-x7k2p in namespace monitoring
+// against a stub API server serving nodes by name, or refusing them when
+// nodes is nil. With the node name from the downward API unset the node is
+// found through the pod.
+func useKubernetesApi(t *testing.T, nodeName string, nodes map[string]map[string]string) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/monitoring/pods/agent-x7k2p", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"spec": {"nodeName": "node-1"}}`))
+	})
+	mux.HandleFunc("/api/v1/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		// no RBAC rule for nodes
+		if nodes == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		labels, ok := nodes[r.URL.Path[len("/api/v1/nodes/"):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var node kubernetesNode
+		node.Metadata.Labels = labels
+		node.Status.Capacity = map[string]string{"cpu": "4", "memory": "16374584Ki"}
+		json.NewEncoder(w).Encode(&node)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+kubernetesTestToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"token": kubernetesTestToken, "namespace": "monitoring"})
+	previousDir, previousConfig, previousWarned := serviceAccountDir, kubernetesConfig, kubernetesWarned
+	serviceAccountDir = dir
+	SetKubernetesConfig(KubernetesConfig{ApiUrl: server.URL})
+	t.Cleanup(func() {
+		serviceAccountDir, kubernetesConfig, kubernetesWarned = previousDir, previousConfig, previousWarned
+	})
+	setTestEnv(t, ENV_NODE_NAME, nodeName)
+	setTestEnv(t, ENV_POD_NAME, "agent-x7k2p")
+	restoreTestEnv(t, ENV_POD_NAMESPACE)
+	os.Unsetenv(ENV_POD_NAMESPACE)
+}
+
+func TestGetKubernetesInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		tags        map[string]string
+		clusterName string
+		wantPool    string
+		wantCluster string
+	}{
+		{"GKE", map[string]string{"cloud.google.com/gke-nodepool": "default-pool"},
+			map[string]string{"cluster-name": "prod-gke", "env": "prod"}, "", "default-pool", "prod-gke"},
+		{"EKS", map[string]string{"eks.amazonaws.com/nodegroup": "ng-1", "alpha.eksctl.io/cluster-name": "prod-eks"},
+			map[string]string{"aws:eks:cluster-name": "tagged-eks"}, "", "ng-1", "prod-eks"},
+		{"AKS", map[string]string{"kubernetes.azure.com/agentpool": "nodepool1", "kubernetes.azure.com/cluster": "MC_rg_prod_westeurope"},
+			nil, "", "nodepool1", "MC_rg_prod_westeurope"},
+		{"kops ownership tag", map[string]string{"kops.k8s.io/instancegroup": "nodes-eu-west-1a"},
+			map[string]string{"kubernetes.io/cluster/prod.k8s.local": "owned"}, "", "nodes-eu-west-1a", "prod.k8s.local"},
+		{"configured name", map[string]string{"alpha.eksctl.io/cluster-name": "prod-eks"},
+			nil, "billing-name", "", "billing-name"},
+		{"no labels", nil, map[string]string{"cluster-name": "prod-gke"}, "", "", "prod-gke"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKubernetesApi(t, "", map[string]map[string]string{"node-1": tt.labels})
+			kubernetesConfig.ClusterName = tt.clusterName
+
+			info := getKubernetesInfo(tt.tags)
+			if info == nil {
+				t.Fatal("getKubernetesInfo() = nil")
+			}
+			if info.NodeName != "node-1" || info.Namespace != "monitoring" || info.PodName != "agent-x7k2p" {
+				t.Errorf("node %q, namespace %q, pod %q", info.NodeName, info.Namespace, info.PodName)
+			}
+			if info.NodePool != tt.wantPool {
+				t.Errorf("node pool = %q, want %q", info.NodePool, tt.wantPool)
+			}
+			if info.ClusterName != tt.wantCluster {
+				t.Errorf("cluster name = %q, want %q", info.ClusterName, tt.wantCluster)
+			}
+			if info.Capacity["cpu"] != "4" {
+				t.Errorf("capacity = %v", info.Capacity)
+			}
+		})
+	}
+}
+
+// without get permission on nodes the cluster name still comes from the tags
+func TestGetKubernetesInfoForbidden(t *testing.T) {
+	useKubernetesApi(t, "node-2", nil)
+	info := getKubernetesInfo(map[string]string{"cluster-name": "prod-gke"})
+	if info == nil {
+		t.Fatal("getKubernetesInfo() = nil")
+	}
+	if info.NodeName != "node-2" || len(info.NodePool) > 0 || info.ClusterName != "prod-gke" {
+		t.Errorf("getKubernetesInfo() = %+v", *info)
+	}
+}
+
+// cloud.tags narrows the reported tags, not the tags naming the cluster
+func TestClusterNameFromFilteredTags(t *testing.T) {
+	previous := cloudConfig
+	defer func() { cloudConfig = previous }()
+	cloudConfig.Tags = TagFilter{Allow: []string{"env"}}
+
+	tags := storedTags(map[string]string{
+		"env":                            "prod",
+		"owner":                          "ops",
+		"aws:eks:cluster-name":           "prod-eks",
+		"kubernetes.io/cluster/prod-eks": "owned",
+		"db-password":                    "hunter2",
+	})
+	want := map[string]string{"env": "prod", "aws:eks:cluster-name": "prod-eks", "kubernetes.io/cluster/prod-eks": "owned"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("storedTags() = %v, want %v", tags, want)
+	}
+	if got := filterTags(tags); !reflect.DeepEqual(got, map[string]string{"env": "prod"}) {
+		t.Errorf("filterTags() = %v, want only env", got)
+	}
+	if name := clusterNameFromTags(tags); name != "prod-eks" {
+		t.Errorf("clusterNameFromTags() = %q, want prod-eks", name)
+	}
+}
@@ -2,11 +2,13 @@ package engine
 
 import (
 	"errors"
+	"fmt"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/net"
+	"runtime"
 	"strings"
 	"time"
 )
@@ -21,6 +23,14 @@ type PartitionUsage struct {
 	FreeGB uint64 `json:"free_gb"`
 	Used uint64 `json:"used"`
 	UsedGB uint64 `json:"used_gb"`
+	// whole disk below the partition, the first one for device mapper
+	// devices spanning several disks
+	Disk string `json:"disk,omitempty"`
+	// the cloud volume of Disk where it can be resolved
+	VolumeId string `json:"volume_id,omitempty"`
+	VolumeType string `json:"volume_type,omitempty"`
+	// name the volume was attached with, where the volume id is unknown
+	VolumeDevice string `json:"volume_device,omitempty"`
 }
 
 type DiskUsage struct {
@@ -39,9 +49,30 @@ type MachineStats struct {
 	ByteReceived uint64  `json:"byteReceived"`
 	Uptime       uint64  `json:"uptime"`
 	Disk 		 DiskUsage `json:"disk"`
+	// host wide, also in the container view
+	Memory *MemoryDetails `json:"memory,omitempty"`
+	Pressure *Pressure `json:"pressure,omitempty"`
+	// host wide, per core only with SetCpuPerCore
+	CpuModes *CpuModes `json:"cpu_modes,omitempty"`
+	CpuCores []CpuModes `json:"cpu_cores,omitempty"`
+	LoadAvg *LoadAvg `json:"load_avg,omitempty"`
+	// per block device, mapped to the mounts in Disk.Usage
+	DiskIO []DiskIOStats `json:"disk_io,omitempty"`
+	// filtered by SetInterfaceFilter
+	Interfaces []InterfaceStats `json:"interfaces,omitempty"`
+	// host or container, see SetStatsView
+	View string `json:"view"`
+	// containers and systemd slices of the host
+	Containers []ContainerStats `json:"containers,omitempty"`
 }
 
-func getMemory(result *MachineStats) error {
+func getMemory(ctx *FetcherContext, result *MachineStats) error {
+	if err := setMemoryDetails(ctx, result); err != nil {
+		return err
+	}
+	if statsView == STATS_VIEW_CONTAINER {
+		return getContainerMemory(result)
+	}
 	vmem, err := mem.VirtualMemory()
 	if err != nil {
 		return err
@@ -51,29 +82,51 @@ func getMemory(result *MachineStats) error {
 	return nil
 }
 
-func getCpu(result *MachineStats) error {
-	m, _ := time.ParseDuration("1s")
+func getCpu(ctx *FetcherContext, result *MachineStats) error {
+	var cgroupBefore cgroupStats
+	var err error
+	if statsView == STATS_VIEW_CONTAINER {
+		if cgroupBefore, err = readCgroup(selfCgroupPaths); err != nil {
+			return err
+		}
+	}
+	before, err := cpuTimes()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	time.Sleep(time.Second)
+	after, err := cpuTimes()
+	if err != nil {
+		return err
+	}
+	setCpuModes(result, before, after)
+	getLoadAvg(result)
+	if statsView == STATS_VIEW_CONTAINER {
+		return getContainerCpu(result, cgroupBefore, time.Since(start))
+	}
 	info, err2 := cpu.Info()
 	if err2 != nil {
 		return err2
 	}
 	result.CoresNumber = len(info)
-	loads, err := cpu.Percent(m, false)
-	if err != nil {
-		return err
-	}
-	if len(loads) == 0 {
+	if result.CpuModes == nil {
 		return errors.New("Failed to obtain CPU loads")
 	}
-	result.CpuLoad = float32(loads[0])
+	// everything but idle, so iowait counts as busy like it always did
+	result.CpuLoad = 100 - result.CpuModes.Idle
+	if result.CpuLoad < 0 {
+		result.CpuLoad = 0
+	}
 	return nil
 }
 
-func getDiskUsage(result *MachineStats) error {
+func getDiskUsage(ctx *FetcherContext, result *MachineStats) error {
 	partitions, err := disk.Partitions(false)
 	if err != nil {
 		return err
 	}
+	volumes := resolveVolumes(ctx)
 	var du DiskUsage
 	du.TotalGB = 0
 	for _, v := range partitions{
@@ -95,6 +148,13 @@ func getDiskUsage(result *MachineStats) error {
 		pu.TotalGB = pu.Total / (1024*1024*1024)
 		pu.UsedGB = pu.TotalGB - pu.FreeGB
 		pu.Used = pu.Total - pu.Free
+		if strings.HasPrefix(v.Device, "/dev/") {
+			pu.Disk = physicalDisk(blockDeviceName(v.Device, v.Mountpoint))
+			volume := volumes[pu.Disk]
+			pu.VolumeId = volume.Id
+			pu.VolumeType = volume.Type
+			pu.VolumeDevice = volume.Device
+		}
 		du.TotalGB += pu.TotalGB
 		du.FreeGB += pu.FreeGB
 		du.Usage = append(du.Usage, pu)
@@ -104,21 +164,67 @@ func getDiskUsage(result *MachineStats) error {
 	return nil
 }
 
-func getNetworkStats(result *MachineStats) error {
-	interfaces, err := net.IOCounters(false)
+func getNetworkStats(ctx *FetcherContext, result *MachineStats) error {
+	var interfaces []net.IOCountersStat
+	var err error
+	if statsView == STATS_VIEW_CONTAINER {
+		// the agent's own network namespace, even when HOST_PROC is set
+		interfaces, err = net.IOCountersByFile(true, "/proc/self/net/dev")
+	} else {
+		interfaces, err = net.IOCounters(true)
+	}
 	if err != nil {
 		return err
 	}
 	if len(interfaces) == 0 {
 		return errors.New("Failed to obtain NIC loads")
 	}
-	result.ByteReceived = interfaces[0].BytesRecv
-	result.BytesSent = interfaces[0].BytesSent
+	// the totals cover every interface, as before the per interface stats
+	for _, iface := range interfaces {
+		result.ByteReceived += iface.BytesRecv
+		result.BytesSent += iface.BytesSent
+	}
+	setInterfaceStats(ctx, result, interfaces)
+	return nil
+}
+
+// getContainerMemory reports the cgroup usage against its limit, or against
+// the host memory when the container is not limited
+func getContainerMemory(result *MachineStats) error {
+	stats, err := readCgroup(selfCgroupPaths)
+	if err != nil {
+		return err
+	}
+	result.UsedMemory = stats.MemoryUsage
+	result.TotalMemory = stats.MemoryLimit
+	if result.TotalMemory == 0 {
+		vmem, err := mem.VirtualMemory()
+		if err != nil {
+			return err
+		}
+		result.TotalMemory = vmem.Total
+	}
+	return nil
+}
 
+// getContainerCpu relates the cgroup CPU time used since before to the
+// cores the container may use
+func getContainerCpu(result *MachineStats, before cgroupStats, elapsed time.Duration) error {
+	after, err := readCgroup(selfCgroupPaths)
+	if err != nil {
+		return err
+	}
+	result.CoresNumber = cpuCores(after.CpuQuota, runtime.NumCPU())
+	cores := after.CpuQuota
+	if cores <= 0 {
+		cores = float64(result.CoresNumber)
+	}
+	used := float64(subtractFloor(after.CpuUsage, before.CpuUsage))
+	result.CpuLoad = float32(100 * used / (float64(elapsed.Nanoseconds()) * cores))
 	return nil
 }
 
-func getUptime(result *MachineStats) error {
+func getUptime(ctx *FetcherContext, result *MachineStats) error {
 	uptime, err := host.Uptime()
 	if err != nil {
 		return err
@@ -127,23 +233,66 @@ func getUptime(result *MachineStats) error {
 	return nil
 }
 
-func GetMachineStats() (*MachineStats, error) {
-	var result MachineStats
-	if err := getMemory(&result); err != nil {
-		return nil, err
+type statCollector struct {
+	name    string
+	collect func(ctx *FetcherContext, result *MachineStats) error
+}
+
+var statCollectors = []statCollector{
+	{"memory", getMemory},
+	{"cpu", getCpu},
+	{"network", getNetworkStats},
+	{"uptime", getUptime},
+	{"disk", getDiskUsage},
+	{"diskio", getDiskIO},
+	{"containers", getContainerStats},
+	{"pressure", getPressure},
+}
+
+// nil means every collector is enabled
+var enabledCollectors map[string]bool
+
+// CollectorNames returns the names of all known collectors
+func CollectorNames() []string {
+	var names []string
+	for _, c := range statCollectors {
+		names = append(names, c.name)
 	}
-	if err := getCpu(&result); err != nil {
-		return nil, err
+	return names
+}
+
+// SetEnabledCollectors restricts GetMachineStats to the named collectors.
+// An empty list enables all of them.
+func SetEnabledCollectors(names []string) error {
+	if len(names) == 0 {
+		enabledCollectors = nil
+		return nil
 	}
-	if err := getNetworkStats(&result); err != nil {
-		return nil, err
+	known := make(map[string]bool)
+	for _, c := range statCollectors {
+		known[c.name] = true
 	}
-	if err := getUptime(&result); err != nil {
-		return nil, err
+	enabled := make(map[string]bool)
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("unknown collector %q, expected one of %s", name, strings.Join(CollectorNames(), ", "))
+		}
+		enabled[name] = true
 	}
-	if err := getDiskUsage(&result); err != nil {
-		return nil, err
+	enabledCollectors = enabled
+	return nil
+}
+
+func GetMachineStats(ctx *FetcherContext) (*MachineStats, error) {
+	var result MachineStats
+	result.View = statsView
+	for _, c := range statCollectors {
+		if enabledCollectors != nil && !enabledCollectors[c.name] {
+			continue
+		}
+		if err := c.collect(ctx, &result); err != nil {
+			return nil, err
+		}
 	}
 	return &result, nil
-
-}
\ No newline at end of file
+}
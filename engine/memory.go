@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+const MEMORY_SAMPLE_KEY = "memorySample"
+
+// MemoryDetails breaks down the host memory in bytes. Available is what can
+// be allocated without swapping, unlike free it counts reclaimable cache.
+type MemoryDetails struct {
+	Available       uint64 `json:"available"`
+	Free            uint64 `json:"free"`
+	Cached          uint64 `json:"cached"`
+	Buffers         uint64 `json:"buffers"`
+	Shared          uint64 `json:"shared"`
+	Slab            uint64 `json:"slab"`
+	SlabReclaimable uint64 `json:"slab_reclaimable"`
+	SwapTotal       uint64 `json:"swap_total"`
+	SwapUsed        uint64 `json:"swap_used"`
+	// bytes swapped in and out and major page faults since boot
+	SwapIn      uint64 `json:"swap_in"`
+	SwapOut     uint64 `json:"swap_out"`
+	MajorFaults uint64 `json:"major_faults"`
+	// since the previous collection, omitted on the first collection and
+	// after a reboot
+	SwapInRate  *float64 `json:"swap_in_per_sec,omitempty"`
+	SwapOutRate *float64 `json:"swap_out_per_sec,omitempty"`
+	// pages of HugePageSize bytes
+	HugePagesTotal uint64 `json:"hugepages_total"`
+	HugePagesFree  uint64 `json:"hugepages_free"`
+	HugePageSize   uint64 `json:"hugepage_size"`
+}
+
+// setMemoryDetails reports the host memory, also in the container view
+func setMemoryDetails(ctx *FetcherContext, result *MachineStats) error {
+	vmem, err := mem.VirtualMemory()
+	if err != nil {
+		return err
+	}
+	details := &MemoryDetails{
+		Available:       vmem.Available,
+		Free:            vmem.Free,
+		Cached:          vmem.Cached,
+		Buffers:         vmem.Buffers,
+		Shared:          vmem.Shared,
+		Slab:            vmem.Slab,
+		SlabReclaimable: vmem.Sreclaimable,
+		HugePagesTotal:  vmem.HugePagesTotal,
+		HugePagesFree:   vmem.HugePagesFree,
+		HugePageSize:    vmem.HugePageSize,
+	}
+	if swap, err := mem.SwapMemory(); err == nil {
+		details.SwapTotal = swap.Total
+		details.SwapUsed = swap.Used
+		details.SwapIn = swap.Sin
+		details.SwapOut = swap.Sout
+		details.MajorFaults = swap.PgMajFault
+
+		previous := loadCounterSample(ctx, MEMORY_SAMPLE_KEY)
+		sample := newCounterSample()
+		sample.set("swap", "in", swap.Sin)
+		sample.set("swap", "out", swap.Sout)
+		if rate, ok := sample.rate(previous, "swap", "in"); ok {
+			details.SwapInRate = &rate
+		}
+		if rate, ok := sample.rate(previous, "swap", "out"); ok {
+			details.SwapOutRate = &rate
+		}
+		storeCounterSample(ctx, MEMORY_SAMPLE_KEY, sample)
+	}
+	result.Memory = details
+	return nil
+}
@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/diskv"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_OUTBOX_MAX_ENTRIES = 5000
+	DEFAULT_OUTBOX_MAX_BYTES   = 64 * 1024 * 1024
+	DEFAULT_OUTBOX_MAX_AGE     = 7 * 24 * time.Hour
+)
+
+// Outbox persists payloads that have not been delivered yet. Entries are
+// keyed by sample timestamp, so a sample is stored at most once and replayed
+// in the order it was collected.
+type Outbox struct {
+	diskv      *diskv.Diskv
+	MaxEntries int
+	MaxBytes   int64
+	MaxAge     time.Duration
+}
+
+func OpenOutbox(storagePath string) *Outbox {
+	flatTransform := func(s string) []string { return []string{} }
+	d := diskv.New(diskv.Options{
+		BasePath:     storagePath,
+		TempDir:      storagePath + ".tmp",
+		Transform:    flatTransform,
+		CacheSizeMax: 0,
+	})
+	return &Outbox{
+		diskv:      d,
+		MaxEntries: DEFAULT_OUTBOX_MAX_ENTRIES,
+		MaxBytes:   DEFAULT_OUTBOX_MAX_BYTES,
+		MaxAge:     DEFAULT_OUTBOX_MAX_AGE,
+	}
+}
+
+// zero padded so that lexical order matches chronological order
+func outboxKey(timestamp int64) string {
+	return fmt.Sprintf("%020d", timestamp)
+}
+
+var noticeNamePattern = regexp.MustCompile(`^[a-z]+$`)
+
+// outboxTimestamp returns the sample timestamp of a key, which may carry
+// the name of a notice, see PutNotice
+func outboxTimestamp(key string) (int64, error) {
+	if i := strings.IndexByte(key, '-'); i >= 0 {
+		if !noticeNamePattern.MatchString(key[i+1:]) {
+			return 0, fmt.Errorf("invalid outbox key %q", key)
+		}
+		key = key[:i]
+	}
+	return strconv.ParseInt(key, 10, 64)
+}
+
+// Put stores payload unless a sample with the same timestamp is already queued
+func (o *Outbox) Put(timestamp int64, payload []byte) error {
+	return o.write(outboxKey(timestamp), payload)
+}
+
+// PutNotice stores an event like an interruption notice under its own key,
+// so it neither replaces nor gets dropped for the sample of the same second.
+// It is replayed right after that sample.
+func (o *Outbox) PutNotice(timestamp int64, name string, payload []byte) error {
+	if !noticeNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid notice name %q", name)
+	}
+	return o.write(outboxKey(timestamp)+"-"+name, payload)
+}
+
+func (o *Outbox) write(key string, payload []byte) error {
+	if o.diskv.Has(key) {
+		return nil
+	}
+	if err := o.diskv.Write(key, payload); err != nil {
+		return err
+	}
+	o.enforceQuota()
+	return nil
+}
+
+func (o *Outbox) keys() []string {
+	var keys []string
+	for key := range o.diskv.Keys(nil) {
+		if _, err := outboxTimestamp(key); err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns the number of queued payloads
+func (o *Outbox) Len() int {
+	return len(o.keys())
+}
+
+func (o *Outbox) enforceQuota() {
+	keys := o.keys()
+	sizes := make([]int64, len(keys))
+	var total int64
+	for i, key := range keys {
+		if info, err := os.Stat(filepath.Join(o.diskv.BasePath, key)); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	oldest := time.Now().Add(-o.MaxAge).Unix()
+	dropped := 0
+	for i, key := range keys {
+		remaining := len(keys) - i
+		timestamp, _ := outboxTimestamp(key)
+		tooOld := o.MaxAge > 0 && timestamp < oldest
+		tooMany := o.MaxEntries > 0 && remaining > o.MaxEntries
+		tooBig := o.MaxBytes > 0 && total > o.MaxBytes
+		if !tooOld && !tooMany && !tooBig {
+			break
+		}
+		if err := o.diskv.Erase(key); err == nil {
+			total -= sizes[i]
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Outbox quota exceeded, dropped %d oldest samples", dropped)
+	}
+}
+
+// Flush replays queued payloads oldest first and removes the delivered ones.
+// It stops at the first transient or authentication failure and returns it;
+// payloads the endpoint permanently rejects are discarded and reported.
+func (o *Outbox) Flush(send func([]byte) error) error {
+	var rejected error
+	o.enforceQuota()
+	for _, key := range o.keys() {
+		payload, err := o.diskv.Read(key)
+		if err != nil {
+			log.Printf("Dropping unreadable outbox entry %s : %v", key, err)
+			o.diskv.Erase(key)
+			continue
+		}
+		err = send(payload)
+		if err != nil {
+			var derr *DeliveryError
+			if errors.As(err, &derr) && derr.Permanent && !derr.IsAuthError() {
+				log.Printf("Dropping rejected sample %s : %v", key, err)
+				o.diskv.Erase(key)
+				rejected = err
+				continue
+			}
+			return err
+		}
+		o.diskv.Erase(key)
+	}
+	return rejected
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testOutbox(t *testing.T) *Outbox {
+	return OpenOutbox(filepath.Join(t.TempDir(), "outbox"))
+}
+
+// recorder collects the payloads it is given and fails with the error
+// configured for a payload
+type recorder struct {
+	sent   []string
+	errors map[string]error
+}
+
+func (r *recorder) send(payload []byte) error {
+	if err := r.errors[string(payload)]; err != nil {
+		return err
+	}
+	r.sent = append(r.sent, string(payload))
+	return nil
+}
+
+func TestOutboxFlush(t *testing.T) {
+	now := time.Now().Unix()
+	transient := &DeliveryError{StatusCode: 503}
+	rejected := &DeliveryError{StatusCode: 400, Permanent: true}
+	auth := &DeliveryError{StatusCode: 401, Permanent: true}
+	tests := []struct {
+		name string
+		// payloads put in this order, keyed by their timestamp offset
+		put       []int64
+		errors    map[string]error
+		wantSent  []string
+		wantLeft  int
+		wantError error
+	}{
+		{"oldest first", []int64{30, 10, 20}, nil, []string{"10", "20", "30"}, 0, nil},
+		{"stored once per second", []int64{10, 10, 5}, nil, []string{"5", "10"}, 0, nil},
+		{"stops at transient error", []int64{10, 20, 30}, map[string]error{"20": transient},
+			[]string{"10"}, 2, transient},
+		{"drops rejected", []int64{10, 20, 30}, map[string]error{"20": rejected},
+			[]string{"10", "30"}, 0, rejected},
+		{"keeps samples on auth error", []int64{10, 20}, map[string]error{"10": auth},
+			nil, 2, auth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOutbox(t)
+			for _, offset := range tt.put {
+				if err := o.Put(now+offset, []byte(fmt.Sprint(offset))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := &recorder{errors: tt.errors}
+			err := o.Flush(r.send)
+			if err != tt.wantError {
+				t.Errorf("Flush() = %v, want %v", err, tt.wantError)
+			}
+			if !reflect.DeepEqual(r.sent, tt.wantSent) {
+				t.Errorf("sent %v, want %v", r.sent, tt.wantSent)
+			}
+			if o.Len() != tt.wantLeft {
+				t.Errorf("%d samples left, want %d", o.Len(), tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestOutboxQuota(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int64
+		maxAge     time.Duration
+		// timestamp offsets of 10 byte payloads
+		put      []int64
+		wantSent []string
+	}{
+		{"within limits", 10, 1000, time.Hour, []int64{1, 2, 3}, []string{"1", "2", "3"}},
+		{"max entries", 2, 1000, time.Hour, []int64{1, 2, 3}, []string{"2", "3"}},
+		{"max bytes", 10, 25, time.Hour, []int64{1, 2, 3, 4}, []string{"3", "4"}},
+		{"max age", 10, 1000, time.Hour, []int64{-7200, -10, 0}, []string{"-10", "0"}},
+		{"no limits", 0, 0, 0, []int64{-7200, 1, 2}, []string{"-7200", "1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOutbox(t)
+			o.MaxEntries = tt.maxEntries
+			o.MaxBytes = tt.maxBytes
+			o.MaxAge = tt.maxAge
+			for _, offset := range tt.put {
+				payload := []byte(fmt.Sprintf("%-10d", offset))
+				if err := o.Put(now+offset, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var sent []string
+			o.Flush(func(payload []byte) error {
+				sent = append(sent, string(bytes.TrimSpace(payload)))
+				return nil
+			})
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Errorf("replayed %v, want %v", sent, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestOutboxPutNotice(t *testing.T) {
+	o := testOutbox(t)
+	now := time.Now().Unix()
+	o.Put(now, []byte("sample"))
+	if err := o.PutNotice(now, "interruption", []byte("notice")); err != nil {
+		t.Fatal(err)
+	}
+	o.Put(now+1, []byte("next"))
+	if err := o.PutNotice(now, "Bad-Name", []byte("x")); err == nil {
+		t.Error("PutNotice accepted an invalid name")
+	}
+	r := &recorder{}
+	if err := o.Flush(r.send); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sample", "notice", "next"}; !reflect.DeepEqual(r.sent, want) {
+		t.Errorf("sent %v, want %v", r.sent, want)
+	}
+}
+
+func TestOutboxTimestamp(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    int64
+		wantErr bool
+	}{
+		{outboxKey(1700000000), 1700000000, false},
+		{outboxKey(1700000000) + "-interruption", 1700000000, false},
+		{"instanceID", 0, true},
+		{"00000000001700000000-000001", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := outboxTimestamp(tt.key)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("outboxTimestamp(%q) = %d, %v, want %d", tt.key, got, err, tt.want)
+		}
+	}
+}
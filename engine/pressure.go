@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PressureAvg is the share of time in percent that tasks were stalled on a
+// resource, averaged over 10, 60 and 300 seconds
+type PressureAvg struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	// total stall time in microseconds
+	Total uint64 `json:"total_us"`
+}
+
+// PressureStat distinguishes some tasks stalled from all tasks stalled
+type PressureStat struct {
+	Some *PressureAvg `json:"some,omitempty"`
+	Full *PressureAvg `json:"full,omitempty"`
+}
+
+// Pressure holds the Linux pressure stall information
+type Pressure struct {
+	Cpu    *PressureStat `json:"cpu,omitempty"`
+	Memory *PressureStat `json:"memory,omitempty"`
+	Io     *PressureStat `json:"io,omitempty"`
+}
+
+// readPressure parses lines like "some avg10=0.00 avg60=0.00 avg300=0.00 total=0"
+func readPressure(fileName string) *PressureStat {
+	data := readTrimmed(fileName)
+	if len(data) == 0 {
+		return nil
+	}
+	var result PressureStat
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var avg PressureAvg
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "avg10":
+				avg.Avg10, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				avg.Avg60, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				avg.Avg300, _ = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				avg.Total, _ = strconv.ParseUint(kv[1], 10, 64)
+			}
+		}
+		switch fields[0] {
+		case "some":
+			result.Some = &avg
+		case "full":
+			result.Full = &avg
+		}
+	}
+	return &result
+}
+
+// getPressure reads /proc/pressure, or the cgroup's pressure files in the
+// container view on cgroup v2. Kernels before 4.20 or booted with psi=0
+// report nothing.
+func getPressure(ctx *FetcherContext, result *MachineStats) error {
+	var pressure Pressure
+	if statsView == STATS_VIEW_CONTAINER && selfCgroupPaths.version == CGROUP_V2 {
+		pressure.Cpu = readPressure(path.Join(selfCgroupPaths.cpu, "cpu.pressure"))
+		pressure.Memory = readPressure(path.Join(selfCgroupPaths.memory, "memory.pressure"))
+		pressure.Io = readPressure(path.Join(selfCgroupPaths.blkio, "io.pressure"))
+	} else {
+		pressure.Cpu = readPressure(hostProcPath("pressure", "cpu"))
+		pressure.Memory = readPressure(hostProcPath("pressure", "memory"))
+		pressure.Io = readPressure(hostProcPath("pressure", "io"))
+	}
+	if pressure.Cpu != nil || pressure.Memory != nil || pressure.Io != nil {
+		result.Pressure = &pressure
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// counterSample is a reading of cumulative counters by object (interface,
+// device) and counter name. The previous one is kept in the fetcher store so
+// that the next collection can compute rates.
+type counterSample struct {
+	// unix nanoseconds
+	Time     int64                        `json:"time"`
+	Boot     string                       `json:"boot"`
+	Counters map[string]map[string]uint64 `json:"counters"`
+}
+
+func newCounterSample() *counterSample {
+	return &counterSample{
+		Time:     time.Now().UnixNano(),
+		Boot:     bootTime(),
+		Counters: make(map[string]map[string]uint64),
+	}
+}
+
+// loadCounterSample returns the sample stored under key, or nil
+func loadCounterSample(ctx *FetcherContext, key string) *counterSample {
+	data, err := ctx.diskv.Read(key)
+	if err != nil {
+		return nil
+	}
+	var sample counterSample
+	if json.Unmarshal(data, &sample) != nil {
+		return nil
+	}
+	return &sample
+}
+
+func storeCounterSample(ctx *FetcherContext, key string, sample *counterSample) {
+	if data, err := json.Marshal(sample); err == nil {
+		ctx.diskv.Write(key, data)
+	}
+}
+
+func (s *counterSample) set(object string, counter string, value uint64) {
+	if s.Counters[object] == nil {
+		s.Counters[object] = make(map[string]uint64)
+	}
+	s.Counters[object][counter] = value
+}
+
+// elapsed returns the seconds since previous, false when there is no usable
+// previous sample because it is missing or was taken before a reboot
+func (s *counterSample) elapsed(previous *counterSample) (float64, bool) {
+	if previous == nil || previous.Boot != s.Boot || s.Time <= previous.Time {
+		return 0, false
+	}
+	return float64(s.Time-previous.Time) / float64(time.Second), true
+}
+
+// delta returns the increase of a counter since previous, false after a
+// reboot or when the counter went backwards, e.g. a recreated interface
+func (s *counterSample) delta(previous *counterSample, object string, counter string) (uint64, bool) {
+	if _, ok := s.elapsed(previous); !ok {
+		return 0, false
+	}
+	before, ok := previous.Counters[object][counter]
+	if !ok {
+		return 0, false
+	}
+	after := s.Counters[object][counter]
+	if after < before {
+		return 0, false
+	}
+	return after - before, true
+}
+
+// rate returns the per second increase of a counter since previous
+func (s *counterSample) rate(previous *counterSample, object string, counter string) (float64, bool) {
+	delta, ok := s.delta(previous, object, counter)
+	if !ok {
+		return 0, false
+	}
+	seconds, _ := s.elapsed(previous)
+	return float64(delta) / seconds, true
+}
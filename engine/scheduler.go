@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_COLLECT_INTERVAL      = 5 * time.Minute
+	DEFAULT_UPDATE_INTERVAL       = time.Hour
+	DEFAULT_INTERRUPTION_INTERVAL = 5 * time.Second
+)
+
+// Scheduler drives periodic collection and update checks in daemon mode.
+type Scheduler struct {
+	CollectInterval time.Duration
+	UpdateInterval  time.Duration
+	// Collect is called once on start and then every CollectInterval.
+	Collect func()
+	// CheckUpdate returns true when a newer application has been installed
+	// and the daemon should be restarted to pick it up.
+	CheckUpdate func() bool
+	// Poll, if set, is called every PollInterval for short lived events. It
+	// runs on its own goroutine, so a Collect blocked on delivery retries
+	// never holds it back.
+	Poll         func()
+	PollInterval time.Duration
+}
+
+// Run blocks until the process receives SIGINT/SIGTERM or an update is
+// installed. It returns true in the latter case.
+func (s *Scheduler) Run() bool {
+	collectInterval := s.CollectInterval
+	if collectInterval <= 0 {
+		collectInterval = DEFAULT_COLLECT_INTERVAL
+	}
+	updateInterval := s.UpdateInterval
+	if updateInterval <= 0 {
+		updateInterval = DEFAULT_UPDATE_INTERVAL
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	collectTicker := time.NewTicker(collectInterval)
+	defer collectTicker.Stop()
+	updateTicker := time.NewTicker(updateInterval)
+	defer updateTicker.Stop()
+	if s.Poll != nil {
+		pollInterval := s.PollInterval
+		if pollInterval <= 0 {
+			pollInterval = DEFAULT_INTERRUPTION_INTERVAL
+		}
+		pollDone := make(chan struct{})
+		defer close(pollDone)
+		go s.poll(pollInterval, pollDone)
+	}
+
+	s.Collect()
+	for {
+		select {
+		case sig := <-stop:
+			log.Printf("Received %v, stopping", sig)
+			return false
+		case <-collectTicker.C:
+			s.Collect()
+		case <-updateTicker.C:
+			if s.CheckUpdate != nil && s.CheckUpdate() {
+				log.Printf("New version installed, restarting")
+				return true
+			}
+		}
+	}
+}
+
+func (s *Scheduler) poll(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.Poll()
+		}
+	}
+}
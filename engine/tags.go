@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"regexp"
+	"strings"
+)
+
+// globMatch matches a shell style pattern with * and ? case-insensitively.
+// Unlike path.Match, * also spans slashes used in keys like kubernetes.io/cluster.
+func globMatch(pattern string, value string) bool {
+	expr := regexp.QuoteMeta(strings.ToLower(pattern))
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	matched, err := regexp.MatchString("^"+expr+"$", strings.ToLower(value))
+	return err == nil && matched
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f TagFilter) allows(key string) bool {
+	if matchesAny(f.Deny, key) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesAny(f.Allow, key)
+}
+
+// tagAllowed applies DEFAULT_TAG_DENY and the cloud.tags allow/deny lists
+// to a tag key
+func tagAllowed(key string) bool {
+	return !matchesAny(DEFAULT_TAG_DENY, key) && cloudConfig.Tags.allows(key)
+}
+
+// tagStored also keeps the tags that may name the Kubernetes cluster, which
+// is reported whether or not cloud.tags lets the tags themselves through
+func tagStored(key string) bool {
+	if matchesAny(DEFAULT_TAG_DENY, key) {
+		return false
+	}
+	return cloudConfig.Tags.allows(key) || clusterNameTag(key)
+}
+
+func clusterNameTag(key string) bool {
+	return matchesAny(clusterNameTags, key) || globMatch(CLUSTER_OWNERSHIP_TAG_PREFIX+"*", key)
+}
+
+// filterTags returns the tags sent to Binadox
+func filterTags(tags map[string]string) map[string]string {
+	return selectTags(tags, tagAllowed)
+}
+
+// storedTags returns the tags read from the metadata service and cached
+func storedTags(tags map[string]string) map[string]string {
+	return selectTags(tags, tagStored)
+}
+
+func selectTags(tags map[string]string, keep func(string) bool) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	result := make(map[string]string)
+	for key, value := range tags {
+		if keep(key) {
+			result[key] = value
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -6,8 +6,13 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 )
 
+// APPLICATION_NAME is the file name of the executable in a release zip
+const APPLICATION_NAME = "binadox-cloud-agent"
+
 func findReleaseCandidate(myTag string) (string, string, error) {
 	releases, err := ListReleases()
 	if err != nil {
@@ -88,4 +93,15 @@ func FetchRelease(myTag string) (string, error) {
 	permissions.SetUserExecute(true)
 	permbits.Chmod(oName, permissions)
 	return oName, nil
-}
\ No newline at end of file
+}
+
+// ApplicationTag returns the release tag of an application installed by
+// FetchRelease, which prefixes the file name with "<tag>-", or "" when the
+// file was not installed by the updater.
+func ApplicationTag(app string) string {
+	name := filepath.Base(app)
+	if i := strings.LastIndex(name, "-"+APPLICATION_NAME); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
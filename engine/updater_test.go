@@ -0,0 +1,23 @@
+package engine
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestApplicationTag(t *testing.T) {
+	tests := []struct {
+		app  string
+		want string
+	}{
+		{filepath.Join("updater", "v1.4.0-binadox-cloud-agent"), "v1.4.0"},
+		{filepath.Join("updater", "v1.4.0-rc1-binadox-cloud-agent.exe"), "v1.4.0-rc1"},
+		{"/usr/local/bin/binadox-cloud-agent", ""},
+		{"/opt/agent", ""},
+	}
+	for _, tt := range tests {
+		if got := ApplicationTag(tt.app); got != tt.want {
+			t.Errorf("ApplicationTag(%q) = %q, want %q", tt.app, got, tt.want)
+		}
+	}
+}
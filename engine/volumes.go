@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	VOLUME_EBS            = "ebs"
+	VOLUME_INSTANCE_STORE = "instance-store"
+)
+
+const VOLUMES_KEY = "volumes"
+
+var devDir = "/dev"
+
+// VolumeInfo identifies the cloud volume behind a disk
+type VolumeInfo struct {
+	Id string
+	// e.g. ebs, instance-store, persistent, scratch, Premium_LRS
+	Type string
+	// device name given when the volume was attached, GCP only reports that
+	Device string
+}
+
+// VolumeMapper is implemented by providers whose metadata service describes
+// the attached volumes
+type VolumeMapper interface {
+	// Volumes returns the volumes by kernel disk name, e.g. nvme1n1 or sdc
+	Volumes(ctx context.Context) (map[string]VolumeInfo, error)
+}
+
+// physicalDisk returns the whole disk below a block device, following
+// device mapper slaves, e.g. nvme1n1 for dm-0 on nvme1n1p1. Volumes spanning
+// several disks report the first one.
+func physicalDisk(name string) string {
+	for depth := 0; depth < 8; depth++ {
+		slaves, err := ioutil.ReadDir(hostSysPath("class", "block", name, "slaves"))
+		if err != nil || len(slaves) == 0 {
+			break
+		}
+		name = slaves[0].Name()
+	}
+	if disk := parentDisk(name); len(disk) > 0 {
+		return disk
+	}
+	return name
+}
+
+// diskLinks resolves the udev symlinks in dir to kernel disk names by link name
+func diskLinks(dir string) map[string]string {
+	result := make(map[string]string)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return result
+	}
+	for _, f := range files {
+		if resolved, err := filepath.EvalSymlinks(path.Join(dir, f.Name())); err == nil {
+			result[f.Name()] = path.Base(resolved)
+		}
+	}
+	return result
+}
+
+// nvmeVolumes reads the volume ids Nitro instances expose as NVMe serials
+func nvmeVolumes() map[string]VolumeInfo {
+	result := make(map[string]VolumeInfo)
+	disks, err := ioutil.ReadDir(hostSysPath("block"))
+	if err != nil {
+		return result
+	}
+	for _, d := range disks {
+		name := d.Name()
+		if !strings.HasPrefix(name, "nvme") {
+			continue
+		}
+		model := readTrimmed(hostSysPath("block", name, "device", "model"))
+		serial := readTrimmed(hostSysPath("block", name, "device", "serial"))
+		switch {
+		case model == "Amazon Elastic Block Store":
+			// vol0123456789abcdef0 is vol-0123456789abcdef0
+			if strings.HasPrefix(serial, "vol") && !strings.HasPrefix(serial, "vol-") {
+				serial = "vol-" + serial[3:]
+			}
+			result[name] = VolumeInfo{Id: serial, Type: VOLUME_EBS}
+		case strings.Contains(model, "Instance Storage"):
+			result[name] = VolumeInfo{Type: VOLUME_INSTANCE_STORE}
+		}
+	}
+	return result
+}
+
+// cachedVolumes is the volume mapping of the disks seen after a boot
+type cachedVolumes struct {
+	Boot    string
+	Cloud   string
+	Disks   []string
+	Volumes map[string]VolumeInfo
+}
+
+func blockDisks() []string {
+	var names []string
+	disks, _ := ioutil.ReadDir(hostSysPath("block"))
+	for _, d := range disks {
+		names = append(names, d.Name())
+	}
+	return names
+}
+
+// resolveVolumes maps the disks of the host to cloud volumes, from sysfs
+// and, on clouds that support it, the metadata service. The mapping is
+// cached until the next reboot or until a disk is attached or detached.
+func resolveVolumes(ctx *FetcherContext) map[string]VolumeInfo {
+	cached, err := loadInstanceID(ctx)
+	if err != nil || cached == nil {
+		return nvmeVolumes()
+	}
+	current := cachedVolumes{Boot: bootTime(), Cloud: cached.Cloud, Disks: blockDisks()}
+	var previous cachedVolumes
+	if data, err := ctx.diskv.Read(VOLUMES_KEY); err == nil && json.Unmarshal(data, &previous) == nil {
+		if previous.Boot == current.Boot && previous.Cloud == current.Cloud &&
+			reflect.DeepEqual(previous.Disks, current.Disks) {
+			return previous.Volumes
+		}
+	}
+
+	result := nvmeVolumes()
+	if mapper, ok := providerForCloud(cached.Cloud).(VolumeMapper); ok {
+		probeCtx, cancel := context.WithTimeout(context.Background(), cloudConfig.Timeout)
+		defer cancel()
+		volumes, err := mapper.Volumes(probeCtx)
+		if err != nil {
+			// asked again on the next collection
+			return result
+		}
+		for disk, v := range volumes {
+			// the NVMe serial is authoritative for the id
+			if known, ok := result[disk]; ok {
+				if len(known.Id) > 0 {
+					v.Id = known.Id
+				}
+				if len(known.Type) > 0 {
+					v.Type = known.Type
+				}
+			}
+			result[disk] = v
+		}
+	}
+	current.Volumes = result
+	if data, err := json.Marshal(current); err == nil {
+		ctx.diskv.Write(VOLUMES_KEY, data)
+	}
+	return result
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/binadox-public/binadox-cloud-agent/engine"
+	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -22,13 +26,24 @@ var (
 	securityToken string
 	serverlUrl string
 	dryRun bool
+	delivery *engine.Delivery
+	outbox *engine.Outbox
+	config engine.Config
 )
 
+// set in the environment of an application started by the launcher
+const supervisedEnv = "BINADOX_AGENT_SUPERVISED"
+
 func parseCmdLineFlags() {
 	var (
 		flgVersion            bool
 		flgWorkDir            string
 		flgToken              string
+		flgTokenFile          string
+		flgTokenStdin         bool
+		flgConfig             string
+		flgCollectors         string
+		flgStatsView          string
 		flgGenerateSignatures bool
 		flgSign               bool
 		flgInFile             string
@@ -36,13 +51,24 @@ func parseCmdLineFlags() {
 		flgPriv               string
 		flgUrl                string
 		flgDryRun             bool
+		flgDaemon             bool
+		flgInterval           time.Duration
+		flgUpdateInterval     time.Duration
 	)
 
     flag.BoolVar(&flgVersion, "version", false, "if set, print version and exit")
     flag.StringVar(&flgWorkDir, "workdir", "", "path to the application data")
+	flag.StringVar(&flgConfig, "config", "", "path to the config file")
 	flag.StringVar(&flgToken, "token", "", "Binadox security token")
+	flag.StringVar(&flgTokenFile, "token-file", "", "file containing the Binadox security token")
+	flag.BoolVar(&flgTokenStdin, "token-stdin", false, "read the Binadox security token from the first line of stdin")
 	flag.StringVar(&flgUrl, "url", "", "Binadox endpoint url")
 	flag.BoolVar(&flgDryRun, "dry-run", false, "if set, just output revealed data")
+	flag.BoolVar(&flgDaemon, "daemon", false, "if set, stay resident and collect periodically")
+	flag.DurationVar(&flgInterval, "interval", engine.DEFAULT_COLLECT_INTERVAL, "collection interval in daemon mode")
+	flag.DurationVar(&flgUpdateInterval, "update-interval", engine.DEFAULT_UPDATE_INTERVAL, "update check interval in daemon mode")
+	flag.StringVar(&flgCollectors, "collectors", "", "comma separated list of enabled collectors")
+	flag.StringVar(&flgStatsView, "stats-view", engine.STATS_VIEW_AUTO, "report the host or the container the agent runs in: auto, host or container")
 
 	flag.BoolVar(&flgGenerateSignatures, "generate-signatures", false, "generate keys and and exit")
 	flag.BoolVar(&flgSign, "zip", false, "generate distribution zip")
@@ -86,54 +112,320 @@ func parseCmdLineFlags() {
 		os.Exit(0)
 	}
 	dryRun = flgDryRun
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	config = engine.DefaultConfig()
+	configFile := flgConfig
+	if len(configFile) == 0 {
+		configFile = os.Getenv(engine.ENV_PREFIX + "CONFIG")
+	}
+	if len(configFile) == 0 {
+		if wd := os.Getenv(engine.ENV_PREFIX + "WORKDIR"); len(wd) > 0 && !explicit["workdir"] {
+			engine.SetWorkDir(wd)
+		}
+		configFile = engine.FindConfigFile()
+	}
+	if len(configFile) > 0 {
+		if err := config.LoadFile(configFile); err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := config.ApplyEnv(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if explicit["workdir"] {
+		config.WorkDir = flgWorkDir
+	}
+	if explicit["token-file"] {
+		config.SetTokenFile(flgTokenFile)
+	}
+	if explicit["token"] {
+		config.SetToken(flgToken)
+	}
+	if flgTokenStdin {
+		token, err := readTokenFromStdin()
+		if err != nil {
+			fmt.Printf("Failed to read token from stdin: %v\n", err)
+			os.Exit(1)
+		}
+		config.SetToken(token)
+	}
+	// Unset BINADOX_TOKEN so it is not inherited by processes we start. This
+	// does not clear it from /proc/self/environ of this process, prefer
+	// --token-file there.
+	os.Unsetenv(engine.ENV_PREFIX + "TOKEN")
+	if explicit["url"] {
+		config.Endpoint.Url = flgUrl
+	}
+	if explicit["daemon"] {
+		config.Daemon = flgDaemon
+	}
+	if explicit["interval"] {
+		config.Interval = flgInterval
+	}
+	if explicit["update-interval"] {
+		config.UpdateInterval = flgUpdateInterval
+	}
+	if explicit["collectors"] {
+		config.Collectors = engine.SplitList(flgCollectors)
+	}
+	if explicit["stats-view"] {
+		config.StatsView = flgStatsView
+	}
+
+	if len(config.WorkDir) > 0 {
+		engine.SetWorkDir(config.WorkDir)
+	}
+	if err := engine.SetCloudConfig(config.Cloud); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	engine.SetKubernetesConfig(config.Kubernetes)
+	engine.SetDockerSocket(config.DockerSocket)
+	engine.SetCpuPerCore(config.CpuPerCore)
+	engine.SetInterfaceFilter(config.NetworkInterfaces)
+	if err := engine.SetEnabledCollectors(config.Collectors); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := engine.SetStatsView(config.StatsView); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
 	if !dryRun {
-		securityToken = flgToken
+		var err error
+		securityToken, err = config.ResolveToken()
+		if err != nil {
+			fmt.Printf("Failed to read token: %v\n", err)
+			os.Exit(1)
+		}
 		if len(securityToken) == 0 {
 			fmt.Printf("--token argument is missing")
 			os.Exit(1)
 		}
-		serverlUrl = flgUrl
+		serverlUrl = config.Endpoint.Url
 		if len(serverlUrl) == 0 {
 			fmt.Printf("--url argument is missing")
 			os.Exit(1)
 		}
+		delivery = engine.NewDelivery(serverlUrl, securityToken)
+		delivery.Client.Timeout = config.Endpoint.Timeout
+		delivery.MaxAttempts = config.Endpoint.MaxAttempts
+		outbox = engine.OpenOutbox(engine.GetOutboxDir())
+		outbox.MaxEntries = config.Outbox.MaxEntries
+		outbox.MaxBytes = config.Outbox.MaxBytes
+		outbox.MaxAge = config.Outbox.MaxAge
 	}
 }
 
-func sendData(body []byte) {
+// sendData queues the sample and replays everything pending, oldest first
+func sendData(timestamp int64, body []byte) error {
 	if dryRun {
-		return
+		return nil
 	}
-	req, err := http.NewRequest("POST", serverlUrl, bytes.NewBuffer(body))
-	if err != nil {
-		log.Fatalf("Error %s", err)
+	if err := outbox.Put(timestamp, body); err != nil {
+		log.Printf("Failed to queue sample: %v", err)
+		return delivery.Send(body)
 	}
+	return outbox.Flush(delivery.Send)
+}
 
-	req.Header.Set("Authorization", fmt.Sprintf("MonitoringToken %s", securityToken))
-	req.Header.Set("Content-Type", "application/json")
+// the interruption poll runs alongside the regular collection and both share
+// the fetcher state
+var fetchMutex sync.Mutex
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Error %s", err)
-	}
-	defer resp.Body.Close()
+func fetch(ctx *engine.FetcherContext, ver string) (*engine.InstanceInfo, error) {
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+	return engine.Fetch(ctx, ver)
 }
 
-func runSelf(ctx *engine.FetcherContext, ver string) {
-	stats, err := engine.Fetch(ctx, ver)
-	if stats == nil {
-		return
-	}
+// runSelf collects and sends a sample. It returns a *engine.CollectionError
+// when nothing could be collected, otherwise the delivery error if any.
+func runSelf(ctx *engine.FetcherContext, ver string) error {
+	stats, err := fetch(ctx, ver)
 	if err == nil {
 		var bytesData []byte
 		bytesData, err = json.MarshalIndent(stats, "", " ")
 		if err == nil {
-			sendData(bytesData)
+			sendErr := sendData(stats.LocalTime, bytesData)
+			if sendErr != nil {
+				log.Printf("%v", sendErr)
+			}
 			jsonTxt := string(bytesData)
 			if dryRun {
 				fmt.Printf("%v\n", jsonTxt)
 			}
+			return sendErr
+		}
+	}
+	log.Printf("Failed to collect data: %v", err)
+	return &engine.CollectionError{Err: err}
+}
+
+// returns the installed application unless it is the running executable or
+// this process was itself started by the launcher
+func latestApplication(ctx *engine.FetcherContext) (string, error) {
+	if len(os.Getenv(supervisedEnv)) > 0 {
+		return "", nil
+	}
+	currentApp, err := engine.GetLatestApplication(ctx)
+	if err != nil || len(currentApp) == 0 {
+		return "", err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return currentApp, nil
+	}
+	selfInfo, errSelf := os.Stat(self)
+	appInfo, errApp := os.Stat(currentApp)
+	if errSelf == nil && errApp == nil && os.SameFile(selfInfo, appInfo) {
+		return "", nil
+	}
+	if abs, errAbs := filepath.Abs(currentApp); errAbs == nil && abs == self {
+		return "", nil
+	}
+	return currentApp, nil
+}
+
+// flags that carry secrets are never put on the child command line
+var secretFlags = map[string]bool{
+	"token":       true,
+	"token-file":  true,
+	"token-stdin": true,
+}
+
+// legacyChildFlags are the flags every release accepts, they are all a child
+// older than this process is given
+var legacyChildFlags = map[string]bool{
+	"workdir": true,
+	"url":     true,
+}
+
+// childCommand starts app with every flag given to this process. The token is
+// written to the child's stdin so it does not show up in the process list.
+// A child older than this release, going by the tag the updater put in its
+// file name, may not know --token-stdin or newer flags: it gets the token in
+// the environment and only the flags every release accepts.
+func childCommand(app string, ver string) *exec.Cmd {
+	current := engine.ApplicationTag(app) >= ver
+	args := []string{"--workdir", engine.GetWorkDir(), "--url", serverlUrl}
+	env := append(os.Environ(), supervisedEnv+"=1")
+	if current {
+		args = append(args, "--token-stdin")
+	} else {
+		env = append(env, engine.ENV_PREFIX+"TOKEN="+securityToken)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if secretFlags[f.Name] || legacyChildFlags[f.Name] {
+			return
+		}
+		if !current {
+			log.Printf("%s predates %s, not passing --%s on", app, ver, f.Name)
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+	cmd := exec.Command(app, args...)
+	cmd.Env = env
+	if current {
+		cmd.Stdin = strings.NewReader(securityToken + "\n")
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func readTokenFromStdin() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// set once the interruption notice has been delivered or queued
+var interruptionReported bool
+
+// pollInterruption pushes a sample as soon as a spot instance learns that it
+// is about to be interrupted. The notice is posted ahead of any queued
+// samples and only goes to the outbox when it can not be delivered.
+func pollInterruption(ctx *engine.FetcherContext, ver string) {
+	if interruptionReported {
+		return
+	}
+	notice, err := engine.CheckInterruption(ctx)
+	if err != nil || notice == nil {
+		return
+	}
+	log.Printf("Instance interruption announced: %s at %s", notice.Action, notice.Time)
+	stats, err := fetch(ctx, ver)
+	if err != nil {
+		log.Printf("Failed to collect data: %v", err)
+		return
+	}
+	stats.Interruption = notice
+	bytesData, err := json.MarshalIndent(stats, "", " ")
+	if err != nil {
+		return
+	}
+	if err = delivery.Send(bytesData); err != nil {
+		log.Printf("%v", err)
+		if err = outbox.PutNotice(stats.LocalTime, "interruption", bytesData); err != nil {
+			log.Printf("Failed to queue interruption notice: %v", err)
+			return
+		}
+	}
+	interruptionReported = true
+}
+
+func checkUpdate(ctx *engine.FetcherContext, ver string) bool {
+	newExe, _ := engine.FetchRelease(ver)
+	if len(newExe) == 0 {
+		return false
+	}
+	if err := engine.SetLatestApplication(ctx, newExe); err != nil {
+		log.Printf("Failed to register %s : %v", newExe, err)
+		return false
+	}
+	return true
+}
+
+// runDaemon keeps the latest application running in daemon mode. The newest
+// installed binary is started as a supervised child and restarted whenever it
+// exits after an update; without one the scheduler runs in this process.
+func runDaemon(ctx *engine.FetcherContext, ver string) {
+	for {
+		currentApp, err := latestApplication(ctx)
+		if err == nil && len(currentApp) > 0 {
+			cmd := childCommand(currentApp, ver)
+			err = cmd.Run()
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == engine.RESTART_EXIT {
+				continue
+			}
+			if err == nil {
+				return
+			}
+			log.Printf("Error executing %s : %v", currentApp, err.Error())
+		}
+
+		scheduler := engine.Scheduler{
+			CollectInterval: config.Interval,
+			UpdateInterval:  config.UpdateInterval,
+			Collect:         func() { runSelf(ctx, ver) },
+			CheckUpdate:     func() bool { return checkUpdate(ctx, ver) },
+			Poll:            func() { pollInterruption(ctx, ver) },
+			PollInterval:    config.InterruptionInterval,
+		}
+		if !scheduler.Run() {
+			return
+		}
+		if len(os.Getenv(supervisedEnv)) > 0 {
+			os.Exit(engine.RESTART_EXIT)
 		}
 	}
 }
@@ -153,8 +445,7 @@ func main() {
 	}
 
 	if dryRun {
-		runSelf(&ctx, myVer)
-		os.Exit(0)
+		os.Exit(engine.DeliveryExitCode(runSelf(&ctx, myVer)))
 	}
 
 	newExe, _ := engine.FetchRelease(myVer)
@@ -162,20 +453,28 @@ func main() {
 		err = engine.SetLatestApplication(&ctx, newExe)
 	}
 
+	if config.Daemon {
+		runDaemon(&ctx, myVer)
+		os.Exit(engine.NORMAL_EXIT)
+	}
+
 	var currentApp string
 	if err == nil {
-		currentApp, err = engine.GetLatestApplication(&ctx)
+		currentApp, err = latestApplication(&ctx)
 	}
 
 	if err != nil || len(currentApp) == 0 {
-		runSelf(&ctx, myVer)
+		os.Exit(engine.DeliveryExitCode(runSelf(&ctx, myVer)))
 	} else {
-		cmd := exec.Command(currentApp, "--workdir", engine.GetWorkDir(), "--token", securityToken, "--url", serverlUrl)
+		cmd := childCommand(currentApp, myVer)
 		err = cmd.Run()
 
+		if exitErr, ok := err.(*exec.ExitError); ok && engine.IsDeliveryExitCode(exitErr.ExitCode()) {
+			os.Exit(exitErr.ExitCode())
+		}
     	if err != nil {
         	log.Printf("Error executing %s : %v", currentApp, err.Error())
-        	runSelf(&ctx, myVer)
+        	os.Exit(engine.DeliveryExitCode(runSelf(&ctx, myVer)))
     	}
 	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"github.com/binadox-public/binadox-cloud-agent/engine"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// parseTestFlags runs parseCmdLineFlags on args in dry run mode with only the
+// given BINADOX_* variables set, restoring flags and environment afterwards
+func parseTestFlags(t *testing.T, args []string, env map[string]string) {
+	t.Helper()
+	previousArgs, previousFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() {
+		os.Args, flag.CommandLine = previousArgs, previousFlags
+		dryRun = false
+	})
+	for _, name := range []string{"CONFIG", "WORKDIR", "URL", "INTERVAL", "TOKEN", "TOKEN_FILE"} {
+		previous, ok := os.LookupEnv(engine.ENV_PREFIX + name)
+		os.Unsetenv(engine.ENV_PREFIX + name)
+		if value, set := env[name]; set {
+			os.Setenv(engine.ENV_PREFIX+name, value)
+		}
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(engine.ENV_PREFIX+name, previous)
+			} else {
+				os.Unsetenv(engine.ENV_PREFIX + name)
+			}
+		})
+	}
+	flag.CommandLine = flag.NewFlagSet("binadox-cloud-agent", flag.ContinueOnError)
+	os.Args = append([]string{"binadox-cloud-agent", "--dry-run", "--workdir", t.TempDir()}, args...)
+	parseCmdLineFlags()
+}
+
+func TestParseCmdLineFlagsPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), engine.CONFIG_FILE_NAME)
+	if err := ioutil.WriteFile(configFile, []byte("endpoint:\n  url: https://file\ninterval: 10m\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		wantUrl      string
+		wantInterval time.Duration
+	}{
+		{"defaults", nil, nil, "", engine.DEFAULT_COLLECT_INTERVAL},
+		{"file", []string{"--config", configFile}, nil, "https://file", 10 * time.Minute},
+		{"config from env", nil, map[string]string{"CONFIG": configFile}, "https://file", 10 * time.Minute},
+		{"env over file", []string{"--config", configFile}, map[string]string{"URL": "https://env", "INTERVAL": "20m"},
+			"https://env", 20 * time.Minute},
+		{"flag over env", []string{"--config", configFile, "--url", "https://flag", "--interval", "30m"},
+			map[string]string{"URL": "https://env", "INTERVAL": "20m"}, "https://flag", 30 * time.Minute},
+		// a flag left at its default does not override the file
+		{"flag default keeps file", []string{"--config", configFile, "--url", "https://flag"}, nil,
+			"https://flag", 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parseTestFlags(t, tt.args, tt.env)
+			if config.Endpoint.Url != tt.wantUrl {
+				t.Errorf("url = %q, want %q", config.Endpoint.Url, tt.wantUrl)
+			}
+			if config.Interval != tt.wantInterval {
+				t.Errorf("interval = %v, want %v", config.Interval, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestParseCmdLineFlagsToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		env           map[string]string
+		wantToken     string
+		wantTokenFile string
+	}{
+		{"env token", nil, map[string]string{"TOKEN": "env-token"}, "env-token", ""},
+		{"flag token file over env token", []string{"--token-file", "/run/secrets/token"},
+			map[string]string{"TOKEN": "env-token"}, "", "/run/secrets/token"},
+		{"flag token over env token file", []string{"--token", "flag-token"},
+			map[string]string{"TOKEN_FILE": "/run/secrets/token"}, "flag-token", ""},
+		// both on the command line: the token is applied last
+		{"flag token and token file", []string{"--token-file", "/run/secrets/token", "--token", "flag-token"},
+			nil, "flag-token", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parseTestFlags(t, tt.args, tt.env)
+			if config.Token != tt.wantToken || config.TokenFile != tt.wantTokenFile {
+				t.Errorf("token = %q, token file = %q, want %q, %q",
+					config.Token, config.TokenFile, tt.wantToken, tt.wantTokenFile)
+			}
+			if _, ok := os.LookupEnv(engine.ENV_PREFIX + "TOKEN"); ok {
+				t.Error("BINADOX_TOKEN is still set for child processes")
+			}
+		})
+	}
+}